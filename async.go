@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	asyncRunning = "running"
+	asyncDone    = "done"
+)
+
+// asyncBroadcast keeps track of a broadcast which has been
+// requested with the X-Async header, so that its outcome can
+// be polled once it completes.
+type asyncBroadcast struct {
+	ID       string           `json:"id"`
+	Method   string           `json:"method"`
+	Path     string           `json:"path"`
+	Group    string           `json:"group,omitempty"`
+	State    string           `json:"state"`
+	Created  time.Time        `json:"created"`
+	Finished *time.Time       `json:"finished,omitempty"`
+	Result   *broadcastResult `json:"result,omitempty"`
+}
+
+var (
+	asyncLocker     sync.RWMutex
+	asyncBroadcasts = make(map[string]*asyncBroadcast)
+)
+
+func newBroadcastId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func isAsync(r *http.Request) bool {
+	return strings.ToLower(r.Header.Get("X-Async")) == "true"
+}
+
+// startAsyncBroadcast registers a new asynchronous broadcast and
+// runs fn in the background. Once done, the outcome is kept for
+// the configured retention and sent to the webhooks, if any.
+func startAsyncBroadcast(id string, r *http.Request, groupName string, hooks []string, fn func() *broadcastResult) *asyncBroadcast {
+	ab := &asyncBroadcast{
+		ID:      id,
+		Method:  r.Method,
+		Path:    r.URL.Path,
+		Group:   groupName,
+		State:   asyncRunning,
+		Created: time.Now(),
+	}
+
+	asyncLocker.Lock()
+	asyncBroadcasts[ab.ID] = ab
+	asyncLocker.Unlock()
+
+	background.Add(1)
+	go func() {
+		defer background.Done()
+
+		res := fn()
+		finished := time.Now()
+
+		asyncLocker.Lock()
+		ab.State = asyncDone
+		ab.Finished = &finished
+		ab.Result = res
+		asyncLocker.Unlock()
+
+		time.AfterFunc(*asyncRetention, func() {
+			asyncLocker.Lock()
+			delete(asyncBroadcasts, ab.ID)
+			asyncLocker.Unlock()
+		})
+
+		if len(hooks) > 0 {
+			deliverWebhooks(hooks, newWebhookPayload(ab.ID, ab.Method, ab.Path, ab.Group, ab.Created, finished, res))
+		}
+	}()
+
+	return ab
+}
+
+// broadcastStatusHandler serves GET /broadcasts/{id}, which returns
+// the state of an asynchronous broadcast and its outcome once done.
+func broadcastStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/broadcasts/")
+
+	asyncLocker.RLock()
+	defer asyncLocker.RUnlock()
+
+	ab, found := asyncBroadcasts[id]
+	if !found {
+		http.Error(w, "Broadcast "+id+" not found.", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	out, _ := json.MarshalIndent(ab, "", "  ")
+	w.Write(out)
+}
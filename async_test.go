@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+// pollBroadcast returns the state of the asynchronous broadcast as
+// served by the API, along with the status code of the answer.
+func pollBroadcast(t *testing.T, id string) (int, asyncBroadcast) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	broadcastStatusHandler(w, httptest.NewRequest(http.MethodGet, "/broadcasts/"+id, nil))
+
+	var ab asyncBroadcast
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &ab); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, ab
+}
+
+func TestAsyncBroadcast(t *testing.T) {
+	defer func(retention time.Duration) { *asyncRetention = retention }(*asyncRetention)
+	*asyncRetention = 50 * time.Millisecond
+
+	release := make(chan struct{})
+	cache := testCache(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusNotFound)
+	})
+	useGroups(t, dao.Group{Name: "prod", Caches: []dao.Cache{cache}})
+
+	r := httptest.NewRequest("PURGE", "/async", nil)
+	r.Header.Set("X-Group", "prod")
+	r.Header.Set("X-Async", "true")
+	w := httptest.NewRecorder()
+	reqHandler(w, r)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got a %d, want a 202", w.Code)
+	}
+	var accepted map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &accepted); err != nil {
+		t.Fatal(err)
+	}
+	id := accepted["id"]
+	if id == "" || w.Header().Get("X-Broadcast-Id") != id {
+		t.Fatalf("got the id %q, and %q in X-Broadcast-Id", id, w.Header().Get("X-Broadcast-Id"))
+	}
+
+	if code, ab := pollBroadcast(t, id); code != http.StatusOK || ab.State != asyncRunning || ab.Result != nil {
+		t.Errorf("while running: got a %d, %+v", code, ab)
+	}
+
+	close(release)
+
+	var ab asyncBroadcast
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if _, ab = pollBroadcast(t, id); ab.State == asyncDone {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the broadcast never finished")
+		}
+	}
+
+	if ab.Group != "prod" || ab.Method != "PURGE" || ab.Path != "/async" || ab.Finished == nil {
+		t.Errorf("got %+v", ab)
+	}
+	if ab.Result == nil || len(ab.Result.Caches) != 1 || ab.Result.Caches[0].Status != http.StatusNotFound {
+		t.Errorf("got the result %+v", ab.Result)
+	}
+
+	// Forgotten once the retention passed.
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if code, _ := pollBroadcast(t, id); code == http.StatusNotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the broadcast is kept past its retention")
+		}
+	}
+}
+
+func TestBroadcastStatusHandler(t *testing.T) {
+	if code, _ := pollBroadcast(t, "unknown"); code != http.StatusNotFound {
+		t.Errorf("unknown id: got a %d, want a 404", code)
+	}
+
+	w := httptest.NewRecorder()
+	broadcastStatusHandler(w, httptest.NewRequest(http.MethodDelete, "/broadcasts/unknown", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE: got a %d, want a 405", w.Code)
+	}
+}
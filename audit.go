@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+const defaultAuditLimit = 100
+
+// auditTarget is the request sent to a cache, once rewritten, and
+// its outcome.
+type auditTarget struct {
+	Cache  string `json:"cache"`
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Host   string `json:"host,omitempty"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// auditRecord is an entry of the audit log, written once a
+// broadcast is done.
+type auditRecord struct {
+	Time     time.Time     `json:"time"`
+	Identity string        `json:"identity,omitempty"`
+	IP       string        `json:"ip,omitempty"`
+	ID       string        `json:"id,omitempty"`
+	Method   string        `json:"method"`
+	Path     string        `json:"path"`
+	Query    string        `json:"query,omitempty"`
+	Host     string        `json:"host,omitempty"`
+	Group    string        `json:"group,omitempty"`
+	Status   int           `json:"status"`
+	Duration float64       `json:"duration"`
+	Targets  []auditTarget `json:"targets"`
+}
+
+// auditLog appends the records to the -audit-log file, rotating
+// it once larger than -audit-max-size.
+type auditLog struct {
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+var audit auditLog
+
+// clientIdentity returns who sent the request: the user it
+// authenticates as, or else the one named by its X-Client-Id
+// header.
+func clientIdentity(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok {
+		return user
+	}
+	return r.Header.Get("X-Client-Id")
+}
+
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// auditTargets returns the requests br was sent as to each cache,
+// along with the outcomes.
+func auditTargets(br broadcastRequest, group dao.Group, outcomes []cacheResult) []auditTarget {
+	var (
+		targets = make([]auditTarget, 0, len(outcomes))
+		caches  = make(map[string]dao.Cache, len(group.Caches))
+	)
+
+	for _, c := range group.Caches {
+		caches[c.Name] = c
+	}
+
+	for _, cr := range outcomes {
+		hbr := br
+		if cr.Host != "" {
+			hbr.Host = cr.Host
+		}
+
+		cache := cacheRequest(hbr, caches[cr.Name])
+		target := auditTarget{Cache: cr.Name, Method: cache.Method, URL: cr.Address + cache.Item, Host: cache.Host, Status: cr.Status, Error: cr.Error}
+		if cache.Parameters != "" {
+			target.URL += "?" + cache.Parameters
+		}
+		targets = append(targets, target)
+	}
+
+	return targets
+}
+
+// newAuditRecord describes the broadcast of br to the group, on
+// behalf of r if it was requested by a client.
+func newAuditRecord(id string, r *http.Request, groupName string, br broadcastRequest, group dao.Group, started time.Time, status int, outcomes []cacheResult) *auditRecord {
+	rec := &auditRecord{
+		Time:     started.UTC(),
+		ID:       id,
+		Method:   br.Method,
+		Path:     br.Path,
+		Query:    br.Query,
+		Host:     br.Host,
+		Group:    groupName,
+		Status:   status,
+		Duration: time.Since(started).Seconds(),
+		Targets:  auditTargets(br, group, outcomes),
+	}
+
+	if len(br.Hosts) > 0 {
+		rec.Host = strings.Join(br.Hosts, ", ")
+	}
+
+	if r != nil {
+		rec.Identity = clientIdentity(r)
+		if r.RemoteAddr != "" {
+			rec.IP = clientIP(r)
+		}
+	}
+
+	return rec
+}
+
+// writeAudit appends the record to the audit log, if enabled.
+func writeAudit(rec *auditRecord) {
+	if *auditLogPath == "" {
+		return
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	audit.lock.Lock()
+	defer audit.lock.Unlock()
+
+	if audit.file != nil && *auditMaxSize > 0 && audit.size+int64(len(line)) > *auditMaxSize {
+		if err = audit.rotate(); err != nil {
+			sendToLogChannel("Rotating the audit log failed: ", err.Error(), "\n")
+		}
+	}
+
+	if audit.file == nil {
+		if err = audit.open(); err != nil {
+			sendToLogChannel("Opening the audit log failed: ", err.Error(), "\n")
+			return
+		}
+	}
+
+	n, err := audit.file.Write(line)
+	audit.size += int64(n)
+	if err != nil {
+		sendToLogChannel("Writing the audit log failed: ", err.Error(), "\n")
+	}
+}
+
+// open opens the audit log for appending. The caller must hold
+// the lock.
+func (l *auditLog) open() error {
+	file, err := os.OpenFile(*auditLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// rotate moves the audit log to path.1, path.1 to path.2 and so
+// on, dropping the oldest beyond -audit-backups. The caller must
+// hold the lock.
+func (l *auditLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+
+	os.Remove(auditFilePath(*auditBackups))
+	for i := *auditBackups - 1; i >= 0; i-- {
+		if err := os.Rename(auditFilePath(i), auditFilePath(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeAuditLog closes the audit log, the records written so far
+// being on disk.
+func closeAuditLog() {
+	audit.lock.Lock()
+	defer audit.lock.Unlock()
+
+	if audit.file != nil {
+		audit.file.Close()
+		audit.file = nil
+	}
+}
+
+// auditFilePath returns the path of the audit log, or of its nth
+// backup.
+func auditFilePath(n int) string {
+	if n == 0 {
+		return *auditLogPath
+	}
+	return *auditLogPath + "." + strconv.Itoa(n)
+}
+
+// auditQuery selects audit records by path, identity and time.
+// A path ending with * matches the paths starting with the rest.
+type auditQuery struct {
+	path     string
+	identity string
+	since    time.Time
+	until    time.Time
+	limit    int
+}
+
+func parseAuditQuery(r *http.Request) (auditQuery, error) {
+	var (
+		q      = auditQuery{limit: defaultAuditLimit}
+		values = r.URL.Query()
+		err    error
+	)
+
+	q.path = values.Get("path")
+	q.identity = values.Get("identity")
+
+	if v := values.Get("since"); v != "" {
+		if q.since, err = parseScheduleTime(v); err != nil {
+			return q, err
+		}
+	}
+	if v := values.Get("until"); v != "" {
+		if q.until, err = parseScheduleTime(v); err != nil {
+			return q, err
+		}
+	}
+	if v := values.Get("limit"); v != "" {
+		if q.limit, err = strconv.Atoi(v); err != nil || q.limit < 1 {
+			return q, fmt.Errorf("Invalid limit %q.", v)
+		}
+	}
+
+	return q, nil
+}
+
+func (q auditQuery) matches(rec *auditRecord) bool {
+	switch {
+	case q.identity != "" && rec.Identity != q.identity:
+		return false
+	case !q.since.IsZero() && rec.Time.Before(q.since):
+		return false
+	case !q.until.IsZero() && rec.Time.After(q.until):
+		return false
+	case strings.HasSuffix(q.path, "*"):
+		return strings.HasPrefix(rec.Path, strings.TrimSuffix(q.path, "*"))
+	}
+	return q.path == "" || rec.Path == q.path
+}
+
+// searchAudit returns the records matching the query, the most
+// recent first, going through the backups as long as needed.
+func searchAudit(q auditQuery) ([]*auditRecord, error) {
+	var found []*auditRecord
+
+	for n := 0; n <= *auditBackups && len(found) < q.limit; n++ {
+		records, err := readAuditFile(auditFilePath(n), q)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for i := len(records) - 1; i >= 0 && len(found) < q.limit; i-- {
+			found = append(found, records[i])
+		}
+	}
+
+	return found, nil
+}
+
+// readAuditFile returns the records of a file matching the query,
+// in the order they were written.
+func readAuditFile(path string, q auditQuery) ([]*auditRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var (
+		records []*auditRecord
+		scanner = bufio.NewScanner(file)
+	)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16<<20)
+
+	for scanner.Scan() {
+		var rec auditRecord
+		if json.Unmarshal(scanner.Bytes(), &rec) != nil {
+			continue
+		}
+		if q.matches(&rec) {
+			records = append(records, &rec)
+		}
+	}
+
+	return records, scanner.Err()
+}
+
+// auditHandler serves GET /audit, which returns the most recent
+// audit records, optionally selected by path, identity, or time
+// range through the since and until parameters.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if *auditLogPath == "" {
+		http.Error(w, "The audit log is disabled.", http.StatusNotFound)
+		return
+	}
+
+	q, err := parseAuditQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// A record being written may be read halfway, it is
+	// skipped then.
+	records, err := searchAudit(q)
+
+	if err != nil {
+		http.Error(w, "Could not read the audit log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if records == nil {
+		records = []*auditRecord{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	out, _ := json.MarshalIndent(records, "", "  ")
+	w.Write(out)
+}
+
+// auditBulk records each item of a bulk request sent to the group,
+// along with its own outcome against each cache.
+func auditBulk(id string, r *http.Request, groupName string, group dao.Group, reqs []broadcastRequest, started time.Time, res *bulkResult) {
+	for idx, br := range reqs {
+		ir := res.outcomes[idx]
+		writeAudit(newAuditRecord(id, r, groupName, br, group, started, ir.Status, ir.Caches))
+	}
+}
+
+// auditRoutedBulk records the items of a bulk request along with
+// their outcome in the group each of them was routed to.
+func auditRoutedBulk(id string, r *http.Request, rs *bulkRoutes, started time.Time, parts []*bulkResult) {
+	for i, route := range rs.routes {
+		auditBulk(id, r, route.name, route.group, route.reqs, started, parts[i])
+	}
+}
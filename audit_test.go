@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+// readAudit enables the audit log for the test and returns a
+// function reading the records written so far.
+func readAudit(t *testing.T) func() []auditRecord {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	saved := *auditLogPath
+	*auditLogPath = path
+
+	t.Cleanup(func() {
+		audit.lock.Lock()
+		if audit.file != nil {
+			audit.file.Close()
+		}
+		audit.file, audit.size = nil, 0
+		audit.lock.Unlock()
+
+		*auditLogPath = saved
+	})
+
+	return func() []auditRecord {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		var records []auditRecord
+		for scanner := bufio.NewScanner(f); scanner.Scan(); {
+			var rec auditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, rec)
+		}
+		return records
+	}
+}
+
+func TestAuditBulkItems(t *testing.T) {
+	records := readAudit(t)
+
+	cache := testCache(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	useGroups(t, dao.Group{Name: "prod", Caches: []dao.Cache{cache}, Policy: dao.DefaultPolicy()})
+
+	r := httptest.NewRequest(http.MethodPost, "/bulk", strings.NewReader("/fine\n/broken\n"))
+	r.Header.Set("X-Group", "prod")
+	w := httptest.NewRecorder()
+	bulkHandler(w, r)
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("got a %d, want a 502", w.Code)
+	}
+
+	got := records()
+	if len(got) != 2 {
+		t.Fatalf("got %d records, want 2", len(got))
+	}
+
+	byPath := make(map[string]auditRecord)
+	for _, rec := range got {
+		byPath[rec.Path] = rec
+	}
+
+	if rec := byPath["/fine"]; rec.Status != http.StatusOK || len(rec.Targets) != 1 || rec.Targets[0].Status != http.StatusOK {
+		t.Errorf("/fine: got %+v", rec)
+	}
+	if rec := byPath["/broken"]; rec.Status != http.StatusBadGateway || len(rec.Targets) != 1 || rec.Targets[0].Status != http.StatusInternalServerError {
+		t.Errorf("/broken: got %+v", rec)
+	}
+}
+
+func TestAuditBulkErrors(t *testing.T) {
+	records := readAudit(t)
+
+	// Nothing listens there, the request fails with an error.
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	cache := dao.Cache{Name: "Gone", Address: srv.URL, Retry: &dao.RetryPolicy{}}
+	warmUpHttpClient(cache)
+	useQueue(t, cache)
+	useGroups(t, dao.Group{Name: "prod", Caches: []dao.Cache{cache}})
+
+	r := httptest.NewRequest(http.MethodPost, "/bulk", strings.NewReader("/page\n"))
+	r.Header.Set("X-Group", "prod")
+	bulkHandler(httptest.NewRecorder(), r)
+
+	got := records()
+	if len(got) != 1 || len(got[0].Targets) != 1 {
+		t.Fatalf("got the records %+v", got)
+	}
+	if target := got[0].Targets[0]; target.Error == "" {
+		t.Errorf("the error is lost: %+v", target)
+	}
+}
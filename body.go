@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+var errBodyTooLarge = errors.New("Request body too large.")
+
+// requestBody is the body of an incoming request, read once and
+// replayed to every cache and on every retry. Bodies larger than
+// -stream-body-size are spooled to a temporary file and streamed
+// from it, the others are kept in memory.
+type requestBody struct {
+	data        []byte
+	file        *os.File
+	size        int64
+	contentType string
+	sum         string
+}
+
+// readRequestBody reads the body of the request, up to
+// -max-body-size bytes. nil is returned if the request has none.
+func readRequestBody(r *http.Request) (*requestBody, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+
+	var (
+		body = &requestBody{contentType: r.Header.Get("Content-Type")}
+		hash = sha256.New()
+		in   = io.TeeReader(io.LimitReader(r.Body, *maxBodySize+1), hash)
+		buf  bytes.Buffer
+		err  error
+	)
+
+	if *streamBodySize > 0 {
+		body.size, err = io.CopyN(&buf, in, *streamBodySize+1)
+	} else {
+		body.size, err = io.Copy(&buf, in)
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if *streamBodySize > 0 && body.size > *streamBodySize {
+		if body.file, err = spoolBody(&buf, in); err != nil {
+			return nil, err
+		}
+
+		info, err := body.file.Stat()
+		if err != nil {
+			body.release()
+			return nil, err
+		}
+		body.size = info.Size()
+	} else {
+		body.data = buf.Bytes()
+	}
+
+	if body.size > *maxBodySize {
+		body.release()
+		return nil, errBodyTooLarge
+	}
+
+	if body.size == 0 {
+		body.release()
+		return nil, nil
+	}
+
+	body.sum = hex.EncodeToString(hash.Sum(nil))
+	return body, nil
+}
+
+// spoolBody writes what was read so far and the rest of the body
+// to a temporary file. The file is removed right away, it lives on
+// until closed.
+func spoolBody(head io.Reader, rest io.Reader) (*os.File, error) {
+	file, err := ioutil.TempFile("", "broadcaster-body-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(file.Name())
+
+	if _, err = io.Copy(file, io.MultiReader(head, rest)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// newMemoryBody returns a body holding data, nil if it is empty.
+func newMemoryBody(data []byte, contentType string) *requestBody {
+	if len(data) == 0 {
+		return nil
+	}
+
+	sum := sha256.Sum256(data)
+	return &requestBody{data: data, size: int64(len(data)), contentType: contentType, sum: hex.EncodeToString(sum[:])}
+}
+
+// open returns a reader over the whole body. Several readers can
+// be open at once.
+func (body *requestBody) open() io.ReadCloser {
+	if body.file != nil {
+		return ioutil.NopCloser(io.NewSectionReader(body.file, 0, body.size))
+	}
+	return ioutil.NopCloser(bytes.NewReader(body.data))
+}
+
+// bytes returns the whole body.
+func (body *requestBody) bytes() ([]byte, error) {
+	if body.file != nil {
+		return ioutil.ReadAll(body.open())
+	}
+	return body.data, nil
+}
+
+// release frees the temporary file the body was spooled to, if
+// any. The body can't be read anymore afterwards.
+func (body *requestBody) release() {
+	if body != nil && body.file != nil {
+		body.file.Close()
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+// useBodySizes sets the -max-body-size and -stream-body-size
+// parameters for the test.
+func useBodySizes(t *testing.T, max, stream int64) {
+	savedMax, savedStream := *maxBodySize, *streamBodySize
+	*maxBodySize, *streamBodySize = max, stream
+	t.Cleanup(func() {
+		*maxBodySize, *streamBodySize = savedMax, savedStream
+	})
+}
+
+func bodyRequest(content string) *http.Request {
+	r := httptest.NewRequest("PURGE", "/", strings.NewReader(content))
+	r.Header.Set("Content-Type", "text/plain")
+	return r
+}
+
+func readAll(t *testing.T, body *requestBody) string {
+	t.Helper()
+
+	data, err := ioutil.ReadAll(body.open())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestReadRequestBodyInMemory(t *testing.T) {
+	useBodySizes(t, 1024, 0)
+
+	body, err := readRequestBody(bodyRequest("tags=product-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.release()
+
+	if body.file != nil || body.size != 14 || body.contentType != "text/plain" || body.sum == "" {
+		t.Errorf("got the body %+v", body)
+	}
+	if got := readAll(t, body); got != "tags=product-1" {
+		t.Errorf("got %q", got)
+	}
+
+	if body, err := readRequestBody(bodyRequest("")); body != nil || err != nil {
+		t.Errorf("empty body: got %+v, %v", body, err)
+	}
+}
+
+func TestReadRequestBodySpooled(t *testing.T) {
+	useBodySizes(t, 1024, 8)
+
+	content := strings.Repeat("0123456789", 10)
+	body, err := readRequestBody(bodyRequest(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.release()
+
+	if body.file == nil || body.data != nil || body.size != int64(len(content)) {
+		t.Fatalf("got the body %+v, want it spooled to disk", body)
+	}
+
+	// The body can be read by several caches at once.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := readAll(t, body); got != content {
+				t.Errorf("got %q", got)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// A spooled body gets the same sum as one held in memory.
+	if memory := newMemoryBody([]byte(content), ""); memory.sum != body.sum {
+		t.Errorf("got the sum %s, want %s", body.sum, memory.sum)
+	}
+}
+
+func TestReadRequestBodyTooLarge(t *testing.T) {
+	for _, stream := range []int64{0, 4} {
+		useBodySizes(t, 10, stream)
+
+		if _, err := readRequestBody(bodyRequest("0123456789")); err != nil {
+			t.Errorf("stream %d: a body of the maximum size refused: %v", stream, err)
+		}
+		if _, err := readRequestBody(bodyRequest("0123456789a")); err != errBodyTooLarge {
+			t.Errorf("stream %d: got %v, want the body refused", stream, err)
+		}
+	}
+
+	useBodySizes(t, 10, 0)
+	useGroups(t, dao.Group{Name: "prod", Caches: []dao.Cache{testCache(t, func(w http.ResponseWriter, r *http.Request) {})}})
+
+	r := bodyRequest(strings.Repeat("0", 11))
+	r.Header.Set("X-Group", "prod")
+	w := httptest.NewRecorder()
+	reqHandler(w, r)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got a %d, want a 413", w.Code)
+	}
+}
+
+func TestBodyReplayedToEveryCache(t *testing.T) {
+	useBodySizes(t, 1024, 8)
+
+	var (
+		lock     sync.Mutex
+		received []string
+		failed   bool
+	)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+
+		lock.Lock()
+		defer lock.Unlock()
+		received = append(received, string(data))
+
+		// The first request fails, to be retried with the body.
+		if !failed {
+			failed = true
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}
+
+	retry := &dao.RetryPolicy{Retries: 1, Status: []dao.StatusRange{{From: 503, To: 503}}}
+	first, second := testCache(t, handler), testCache(t, handler)
+	first.Retry, second.Retry = retry, retry
+	useGroups(t, dao.Group{Name: "prod", Caches: []dao.Cache{first, second}})
+
+	content := strings.Repeat("tags=product-1\n", 10)
+	r := bodyRequest(content)
+	r.Header.Set("X-Group", "prod")
+	w := httptest.NewRecorder()
+	reqHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got a %d: %s", w.Code, w.Body.String())
+	}
+	if len(received) != 3 {
+		t.Fatalf("the caches got %d requests, want 3", len(received))
+	}
+	for i, got := range received {
+		if got != content {
+			t.Errorf("request %d: got the body %q", i, got)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+const (
+	circuitClosed   = "closed"
+	circuitHalfOpen = "half-open"
+	circuitOpen     = "open"
+
+	// The window of a breaker is split into buckets, which are
+	// dropped one at a time as the window slides.
+	breakerBuckets = 10
+)
+
+var errCircuitOpen = errors.New("circuit open")
+
+type breakerBucket struct {
+	slot     int64
+	requests int
+	failures int
+}
+
+// breaker is the circuit breaker of a cache. While the circuit is
+// open, requests against the cache fail right away instead of
+// waiting for it to time out.
+type breaker struct {
+	lock     sync.Mutex
+	name     string
+	address  string
+	settings *dao.BreakerSettings
+	state    string
+	openedAt time.Time
+	probing  int
+	trips    int
+	buckets  [breakerBuckets]breakerBucket
+}
+
+// breakerStatus is the state of a breaker as shown by the API.
+type breakerStatus struct {
+	Name     string     `json:"name"`
+	Address  string     `json:"address"`
+	State    string     `json:"state"`
+	Requests int        `json:"requests"`
+	Failures int        `json:"failures"`
+	Trips    int        `json:"trips"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+var (
+	breakersLocker sync.Mutex
+	breakers       = make(map[string]*breaker)
+)
+
+// cacheBreaker returns the breaker of the cache, or nil if the
+// cache has none.
+func cacheBreaker(cache dao.Cache) *breaker {
+	breakersLocker.Lock()
+	defer breakersLocker.Unlock()
+
+	return breakers[cache.Address]
+}
+
+// setUpBreakers gives a breaker to each cache whose group has
+// breaker settings. A breaker whose settings changed keeps the
+// state of its circuit, the ones of caches which are gone or lost
+// their settings are removed.
+func setUpBreakers() {
+	var seen = make(map[string]bool)
+
+	locker.Lock()
+	caches := allCaches
+	locker.Unlock()
+
+	breakersLocker.Lock()
+	defer breakersLocker.Unlock()
+
+	for _, cache := range caches {
+		// A cache found in several groups gets the
+		// settings of the first one.
+		if seen[cache.Address] {
+			continue
+		}
+		seen[cache.Address] = true
+
+		if cache.Breaker == nil {
+			delete(breakers, cache.Address)
+			continue
+		}
+
+		b, found := breakers[cache.Address]
+		if !found {
+			breakers[cache.Address] = &breaker{name: cache.Name, address: cache.Address, state: circuitClosed, settings: cache.Breaker}
+			continue
+		}
+
+		b.lock.Lock()
+		b.name, b.settings = cache.Name, cache.Breaker
+		b.lock.Unlock()
+	}
+
+	for address := range breakers {
+		if !seen[address] {
+			delete(breakers, address)
+		}
+	}
+}
+
+func (b *breaker) slot(now time.Time) int64 {
+	return now.UnixNano() / int64(b.settings.Window/breakerBuckets)
+}
+
+// counts returns the number of requests and failures over the window.
+func (b *breaker) counts(now time.Time) (int, int) {
+	var (
+		requests, failures int
+		slot               = b.slot(now)
+	)
+
+	for _, bucket := range b.buckets {
+		if bucket.slot > slot-breakerBuckets {
+			requests += bucket.requests
+			failures += bucket.failures
+		}
+	}
+
+	return requests, failures
+}
+
+func (b *breaker) trip(now time.Time) {
+	b.state = circuitOpen
+	b.openedAt = now
+	b.trips++
+	sendToLogChannel("Circuit of ", b.name, " opened.\n")
+}
+
+// allow reports whether a request may be sent to the cache. Once
+// the cooldown is over, an open circuit is half-opened and lets a
+// few probing requests through.
+func (b *breaker) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.state == circuitOpen {
+		if time.Since(b.openedAt) < b.settings.Cooldown {
+			return false
+		}
+		b.state = circuitHalfOpen
+		b.probing = 0
+	}
+
+	if b.state == circuitHalfOpen {
+		if b.probing >= b.settings.Probes {
+			return false
+		}
+		b.probing++
+	}
+
+	return true
+}
+
+// record accounts for the outcome of an allowed request. A probing
+// request closes the circuit if it succeeded and opens it again
+// otherwise.
+func (b *breaker) record(failed bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+
+	switch b.state {
+	case circuitHalfOpen:
+		b.probing--
+		if failed {
+			b.trip(now)
+			return
+		}
+		b.state = circuitClosed
+		b.buckets = [breakerBuckets]breakerBucket{}
+		sendToLogChannel("Circuit of ", b.name, " closed.\n")
+	case circuitClosed:
+		slot := b.slot(now)
+		bucket := &b.buckets[slot%breakerBuckets]
+		if bucket.slot != slot {
+			*bucket = breakerBucket{slot: slot}
+		}
+
+		bucket.requests++
+		if failed {
+			bucket.failures++
+		}
+
+		requests, failures := b.counts(now)
+		if requests >= b.settings.MinRequests && float64(failures) >= b.settings.FailureRate*float64(requests) {
+			b.trip(now)
+		}
+	}
+}
+
+// release gives back the slot of a probing request whose outcome
+// is unknown, as it was canceled.
+func (b *breaker) release() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.state == circuitHalfOpen && b.probing > 0 {
+		b.probing--
+	}
+}
+
+func (b *breaker) status() breakerStatus {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	st := breakerStatus{Name: b.name, Address: b.address, State: b.state, Trips: b.trips}
+	st.Requests, st.Failures = b.counts(time.Now())
+
+	if b.state != circuitClosed {
+		openedAt := b.openedAt
+		st.OpenedAt = &openedAt
+	}
+
+	return st
+}
+
+func breakerStatuses() []breakerStatus {
+	breakersLocker.Lock()
+	var statuses = make([]breakerStatus, 0, len(breakers))
+	for _, b := range breakers {
+		statuses = append(statuses, b.status())
+	}
+	breakersLocker.Unlock()
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Address < statuses[j].Address
+	})
+
+	return statuses
+}
+
+// circuitsHandler serves GET /circuits, which returns the state
+// of the breaker of each cache.
+func circuitsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	out, _ := json.MarshalIndent(breakerStatuses(), "", "  ")
+	w.Write(out)
+}
+
+func writeBreakerMetrics(w io.Writer) {
+	var (
+		statuses = breakerStatuses()
+		states   = map[string]int{circuitClosed: 0, circuitHalfOpen: 1, circuitOpen: 2}
+	)
+
+	fmt.Fprintln(w, "# HELP broadcaster_circuit_state State of the circuit breaker of a cache, 0 closed, 1 half-open, 2 open.")
+	fmt.Fprintln(w, "# TYPE broadcaster_circuit_state gauge")
+	for _, st := range statuses {
+		fmt.Fprintf(w, "broadcaster_circuit_state{cache=%s,address=%s} %d\n", metricLabel(st.Name), metricLabel(st.Address), states[st.State])
+	}
+
+	fmt.Fprintln(w, "# HELP broadcaster_circuit_trips_total Number of times the circuit breaker of a cache opened.")
+	fmt.Fprintln(w, "# TYPE broadcaster_circuit_trips_total counter")
+	for _, st := range statuses {
+		fmt.Fprintf(w, "broadcaster_circuit_trips_total{cache=%s,address=%s} %d\n", metricLabel(st.Name), metricLabel(st.Address), st.Trips)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+func newTestBreaker(settings *dao.BreakerSettings) *breaker {
+	return &breaker{name: "Cache1", address: "http://cache1", state: circuitClosed, settings: settings}
+}
+
+func TestBreakerTrips(t *testing.T) {
+	b := newTestBreaker(&dao.BreakerSettings{Window: time.Minute, MinRequests: 4, FailureRate: 0.5, Cooldown: time.Hour, Probes: 1})
+
+	// Below the minimum number of requests, failures don't count.
+	for i := 0; i < 3; i++ {
+		if !b.allow() {
+			t.Fatalf("request %d refused by a closed circuit", i)
+		}
+		b.record(true)
+	}
+	if b.state != circuitClosed {
+		t.Fatalf("circuit %s below min-requests", b.state)
+	}
+
+	b.allow()
+	b.record(false)
+	if b.state != circuitOpen || b.trips != 1 {
+		t.Fatalf("circuit %s after 3 failures out of 4, trips %d", b.state, b.trips)
+	}
+
+	if b.allow() {
+		t.Error("open circuit let a request through before the cooldown")
+	}
+}
+
+func TestBreakerStaysClosedBelowTheRate(t *testing.T) {
+	b := newTestBreaker(&dao.BreakerSettings{Window: time.Minute, MinRequests: 2, FailureRate: 0.5, Cooldown: time.Hour, Probes: 1})
+
+	for i := 0; i < 10; i++ {
+		b.allow()
+		b.record(i >= 6)
+	}
+	if b.state != circuitClosed {
+		t.Errorf("circuit %s with 4 failures out of 10", b.state)
+	}
+}
+
+func TestBreakerProbes(t *testing.T) {
+	b := newTestBreaker(&dao.BreakerSettings{Window: time.Minute, MinRequests: 1, FailureRate: 0.5, Cooldown: 10 * time.Millisecond, Probes: 2})
+
+	b.allow()
+	b.record(true)
+	if b.state != circuitOpen {
+		t.Fatalf("circuit %s after a failure", b.state)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// Once the cooldown is over, only Probes requests go through.
+	if !b.allow() || !b.allow() {
+		t.Fatal("half-open circuit refused its probes")
+	}
+	if b.state != circuitHalfOpen {
+		t.Fatalf("circuit %s after the cooldown", b.state)
+	}
+	if b.allow() {
+		t.Fatal("half-open circuit let more requests than probes through")
+	}
+
+	// A canceled probe gives its slot back.
+	b.release()
+	if !b.allow() {
+		t.Fatal("released probe slot not reused")
+	}
+
+	// A failed probe opens the circuit again.
+	b.record(true)
+	if b.state != circuitOpen || b.trips != 2 {
+		t.Fatalf("circuit %s after a failed probe, trips %d", b.state, b.trips)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// A successful probe closes it, forgetting the past failures.
+	b.allow()
+	b.record(false)
+	if b.state != circuitClosed {
+		t.Fatalf("circuit %s after a successful probe", b.state)
+	}
+	if requests, failures := b.counts(time.Now()); requests != 0 || failures != 0 {
+		t.Errorf("counts %d/%d kept once closed", failures, requests)
+	}
+}
+
+func TestBreakerWindowSlides(t *testing.T) {
+	b := newTestBreaker(&dao.BreakerSettings{Window: time.Minute, MinRequests: 1, FailureRate: 1, Cooldown: time.Hour, Probes: 1})
+
+	now := time.Now()
+	b.buckets[b.slot(now.Add(-2*time.Minute))%breakerBuckets] = breakerBucket{slot: b.slot(now.Add(-2 * time.Minute)), requests: 5, failures: 5}
+
+	if requests, _ := b.counts(now); requests != 0 {
+		t.Errorf("requests older than the window counted: %d", requests)
+	}
+}
+
+func TestSetUpBreakers(t *testing.T) {
+	var (
+		first  = &dao.BreakerSettings{Window: time.Minute, MinRequests: 1, FailureRate: 1, Cooldown: time.Hour, Probes: 1}
+		second = &dao.BreakerSettings{Window: time.Second, MinRequests: 5, FailureRate: 0.5, Cooldown: time.Second, Probes: 2}
+		shared = dao.Cache{Name: "Cache1", Address: "http://cache1"}
+		other  = dao.Cache{Name: "Cache2", Address: "http://cache2"}
+	)
+
+	setCaches := func(caches ...dao.Cache) {
+		locker.Lock()
+		allCaches = caches
+		locker.Unlock()
+		setUpBreakers()
+	}
+
+	locker.Lock()
+	saved := allCaches
+	locker.Unlock()
+	t.Cleanup(func() { setCaches(saved...) })
+
+	// A cache found in several groups gets the settings of the
+	// first one, whatever group it is broadcasted through.
+	withFirst, withSecond := shared, shared
+	withFirst.Breaker, withSecond.Breaker = first, second
+	setCaches(withFirst, withSecond, other)
+
+	b := cacheBreaker(withSecond)
+	if b == nil || b.settings != first {
+		t.Fatalf("got the breaker %+v, want the settings of the first group", b)
+	}
+	if cacheBreaker(other) != nil {
+		t.Error("a cache without breaker settings got a breaker")
+	}
+
+	// A reload keeps the state of the circuit.
+	b.allow()
+	b.record(true)
+	setCaches(withSecond)
+
+	if got := cacheBreaker(shared); got != b || got.settings != second || got.state != circuitOpen {
+		t.Errorf("got the breaker %+v after a reload, want the same open circuit with the new settings", got)
+	}
+
+	setCaches(other)
+	if cacheBreaker(shared) != nil {
+		t.Error("the breaker of a removed cache is still there")
+	}
+}
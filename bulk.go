@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+const (
+	maxBulkBodySize   = 10 << 20
+	defaultBulkMethod = "PURGE"
+)
+
+// bulkItem is a single entry of a bulk request, either given as
+// a bare path or as an object.
+type bulkItem struct {
+	Method   string            `json:"method,omitempty"`
+	Path     string            `json:"path"`
+	Host     string            `json:"host,omitempty"`
+	Hosts    []string          `json:"hosts,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Priority string            `json:"priority,omitempty"`
+	Intent   string            `json:"intent,omitempty"`
+	Keys     string            `json:"keys,omitempty"`
+}
+
+func (item *bulkItem) UnmarshalJSON(data []byte) error {
+	var path string
+	if err := json.Unmarshal(data, &path); err == nil {
+		item.Path = path
+		return nil
+	}
+
+	type plain bulkItem
+	return json.Unmarshal(data, (*plain)(item))
+}
+
+// bulkItemResult holds the status code received from each cache
+// for a given item.
+type bulkItemResult struct {
+	// Group the item was broadcasted to, given when the items
+	// are routed to several groups.
+	Group     string         `json:"group,omitempty"`
+	Method    string         `json:"method"`
+	Path      string         `json:"path"`
+	Host      string         `json:"host,omitempty"`
+	PolicyMet *bool          `json:"policy_met,omitempty"`
+	Caches    map[string]int `json:"caches"`
+	Stages    []stageResult  `json:"stages,omitempty"`
+}
+
+type bulkResult struct {
+	Status    int              `json:"status"`
+	PolicyMet *bool            `json:"policy_met,omitempty"`
+	Items     []bulkItemResult `json:"items"`
+
+	// Outcome of each item against each cache, errors included.
+	outcomes []*broadcastResult
+}
+
+// parseBulkItems reads the items of a bulk request body. A JSON
+// array is expected if the content type says so, otherwise each
+// line holds either a path or a JSON object.
+func parseBulkItems(r *http.Request) ([]bulkItem, error) {
+	var items []bulkItem
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxBulkBodySize))
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		err = json.Unmarshal(body, &items)
+		return items, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBulkBodySize)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var item bulkItem
+		if strings.HasPrefix(line, "{") {
+			if err := json.Unmarshal([]byte(line), &item); err != nil {
+				return nil, err
+			}
+		} else {
+			item.Path = line
+		}
+		items = append(items, item)
+	}
+
+	return items, scanner.Err()
+}
+
+// bulkRequest turns an item into the request sent to each cache,
+// defaulting to the method and host of the bulk request itself.
+// Unless asked otherwise, items are broadcasted with a low priority
+// so that they don't hold back the other broadcasts.
+func bulkRequest(item bulkItem, r *http.Request, group dao.Group) (broadcastRequest, error) {
+	if !strings.HasPrefix(item.Path, "/") {
+		return broadcastRequest{}, fmt.Errorf("Invalid path %q, paths must start with a slash.", item.Path)
+	}
+
+	br := broadcastRequest{
+		Method:  item.Method,
+		Path:    item.Path,
+		Host:    item.Host,
+		Headers: make(http.Header),
+	}
+
+	if i := strings.Index(item.Path, "?"); i != -1 {
+		br.Path, br.Query = item.Path[:i], item.Path[i+1:]
+	}
+
+	if br.Method == "" {
+		br.Method = r.Header.Get("X-Method")
+	}
+	if br.Method == "" {
+		br.Method = defaultBulkMethod
+	}
+
+	if br.Host == "" {
+		br.Host = r.Host
+	}
+
+	for k, v := range item.Headers {
+		br.Headers.Set(k, v)
+	}
+
+	// The intent of the bulk request applies to the items which
+	// don't ask for a method or an intent of their own.
+	var intent, keys = item.Intent, item.Keys
+	if intent == "" && item.Method == "" {
+		intent = r.Header.Get("X-Invalidate")
+	}
+	if keys == "" {
+		keys = r.Header.Get("X-Keys")
+	}
+
+	err := applyIntent(&br, intent, keys, group)
+	if err != nil {
+		return broadcastRequest{}, err
+	}
+
+	if item.Priority != "" {
+		br.Priority, err = dao.ParsePriority(item.Priority)
+	} else {
+		br.Priority, err = requestPriority(r, group, br.Method, dao.PriorityLow)
+	}
+	if err != nil {
+		return broadcastRequest{}, err
+	}
+
+	return br, nil
+}
+
+// itemHosts returns the hosts an item is broadcasted for, each of
+// them making an item of its own. Items which don't name any host
+// default to the ones listed in the X-Hosts header of the bulk
+// request, if any.
+func itemHosts(item bulkItem, r *http.Request) []string {
+	switch {
+	case len(item.Hosts) > 0:
+		return item.Hosts
+	case item.Host != "":
+		return []string{item.Host}
+	}
+
+	if hosts := requestHosts(r); len(hosts) > 0 {
+		return hosts
+	}
+	return []string{""}
+}
+
+// bulkRoute holds the requests of a bulk request sent to one of
+// the groups it is routed to, along with the index of each of them
+// among all the requests.
+type bulkRoute struct {
+	name    string
+	group   dao.Group
+	reqs    []broadcastRequest
+	indexes []int
+}
+
+type bulkRoutes struct {
+	routes []*bulkRoute
+	total  int
+}
+
+// add appends the request to the ones sent to the group.
+func (rs *bulkRoutes) add(name string, group dao.Group, br broadcastRequest) {
+	var route *bulkRoute
+	for _, rt := range rs.routes {
+		if rt.name == name {
+			route = rt
+		}
+	}
+	if route == nil {
+		route = &bulkRoute{name: name, group: group}
+		rs.routes = append(rs.routes, route)
+	}
+
+	route.reqs = append(route.reqs, br)
+	route.indexes = append(route.indexes, rs.total)
+	rs.total++
+}
+
+// names names the groups of the routes, for the logs and the
+// reports of the request.
+func (rs *bulkRoutes) names() string {
+	var names = make([]string, len(rs.routes))
+	for i, route := range rs.routes {
+		names[i] = route.name
+	}
+	return strings.Join(names, ",")
+}
+
+// caches returns the number of caches of the routes, a cache
+// found in several of them being counted once.
+func (rs *bulkRoutes) caches() int {
+	var groups = make([]dao.Group, len(rs.routes))
+	for i, route := range rs.routes {
+		groups[i] = route.group
+	}
+	return countCaches(groups)
+}
+
+// broadcastRoutedBulk broadcasts the requests of each route to its
+// group, at the same time, and gathers their outcomes in the order
+// of the requests along with the outcome in each group. Each group
+// judges its items against its own policy. If given, progress is
+// called with the route of each item and its index there.
+func broadcastRoutedBulk(ctx context.Context, rs *bulkRoutes, progress func(*bulkRoute, int, cacheResult)) (*bulkResult, []*bulkResult) {
+	var (
+		wg    sync.WaitGroup
+		parts = make([]*bulkResult, len(rs.routes))
+	)
+
+	for i, route := range rs.routes {
+		var routeProgress func(int, cacheResult)
+		if progress != nil {
+			routeProgress = func(route *bulkRoute) func(int, cacheResult) {
+				return func(idx int, cr cacheResult) {
+					progress(route, idx, cr)
+				}
+			}(route)
+		}
+
+		wg.Add(1)
+		go func(i int, route *bulkRoute, progress func(int, cacheResult)) {
+			defer wg.Done()
+			parts[i] = broadcastBulk(ctx, route.reqs, route.group, progress)
+		}(i, route, routeProgress)
+	}
+
+	wg.Wait()
+
+	if len(parts) == 1 {
+		return parts[0], parts
+	}
+
+	var (
+		res      = &bulkResult{Items: make([]bulkItemResult, rs.total)}
+		outcomes = make([]*broadcastResult, len(parts))
+	)
+
+	for i, route := range rs.routes {
+		for j, item := range parts[i].Items {
+			item.Group = route.name
+			res.Items[route.indexes[j]] = item
+		}
+		outcomes[i] = &broadcastResult{Status: parts[i].Status, PolicyMet: parts[i].PolicyMet}
+	}
+
+	res.Status, res.PolicyMet = combinedStatus(outcomes, nil)
+	return res, parts
+}
+
+// bulkProgress is the outcome of an item against a cache, as
+// streamed to the client.
+type bulkProgress struct {
+	Item   int    `json:"item"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Host   string `json:"host,omitempty"`
+	cacheResult
+}
+
+// bulkSummary ends the stream of a bulk request.
+type bulkSummary struct {
+	Status    int   `json:"status"`
+	PolicyMet *bool `json:"policy_met,omitempty"`
+	Items     int   `json:"items"`
+	Failures  int   `json:"failures"`
+}
+
+// broadcastBulk sends every request to every cache of the group.
+// Each cache is handed at most -bulk-concurrency jobs at a time, so
+// that a bulk request does not take over the queue of a cache. If
+// given, progress is called with the outcome of each item against
+// each cache as soon as it is known.
+//
+// Each item is judged on its own against the policy of the group,
+// which is met only if it is met for every item. The stages of the
+// group, if any, are broadcasted to one after the other, an item
+// being skipped in the stages following the one it failed in. Once
+// the context is done, the items which were not handled yet are
+// reported as timed out.
+func broadcastBulk(ctx context.Context, reqs []broadcastRequest, group dao.Group, progress func(int, cacheResult)) *bulkResult {
+	var (
+		wg       sync.WaitGroup
+		caches   = group.Caches
+		outcomes = make([][]cacheResult, len(reqs))
+		res      = &bulkResult{Items: make([]bulkItemResult, len(reqs))}
+		parallel = *bulkConcurrency
+	)
+
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	var (
+		failedStage = make([]string, len(reqs))
+		itemStages  = make([][]stageResult, len(reqs))
+	)
+
+	for idx := range reqs {
+		outcomes[idx] = make([]cacheResult, len(caches))
+	}
+
+	for stage, stageCaches := range group.StageCaches() {
+		var pending []int
+
+		for idx := range reqs {
+			if failedStage[idx] == "" {
+				pending = append(pending, idx)
+				continue
+			}
+
+			for _, cacheIdx := range stageCaches {
+				cr := skippedResult(caches[cacheIdx], failedStage[idx])
+				outcomes[idx][cacheIdx] = cr
+
+				if progress != nil {
+					progress(idx, cr)
+				}
+			}
+		}
+
+		for _, cacheIdx := range stageCaches {
+			indexes := make(chan int, len(pending))
+			for _, idx := range pending {
+				indexes <- idx
+			}
+			close(indexes)
+
+			for i := 0; i < parallel && i < len(pending); i++ {
+				wg.Add(1)
+
+				go func(cacheIdx int, cache dao.Cache) {
+					defer wg.Done()
+
+					for idx := range indexes {
+						var cr cacheResult
+
+						if ctx.Err() != nil {
+							cr = unfinishedResult(ctx, cache)
+						} else {
+							cr = waitJob(dispatch(ctx, reqs[idx], cache))
+						}
+						outcomes[idx][cacheIdx] = cr
+
+						if progress != nil {
+							progress(idx, cr)
+						}
+					}
+				}(cacheIdx, caches[cacheIdx])
+			}
+		}
+
+		wg.Wait()
+
+		if len(group.Stages) == 0 {
+			continue
+		}
+
+		for idx := range reqs {
+			var stageOutcomes = make([]cacheResult, len(stageCaches))
+			for i, cacheIdx := range stageCaches {
+				stageOutcomes[i] = outcomes[idx][cacheIdx]
+			}
+
+			sr := newStageResult(group.Stages[stage].Name, stageOutcomes, stagePolicy(group), failedStage[idx] != "")
+			itemStages[idx] = append(itemStages[idx], sr)
+
+			if !sr.PolicyMet && failedStage[idx] == "" {
+				failedStage[idx] = sr.Name
+			}
+		}
+	}
+
+	var items = make([]*broadcastResult, len(reqs))
+
+	for idx, br := range reqs {
+		ir := &broadcastResult{Caches: outcomes[idx], Stages: itemStages[idx], policy: group.Policy}
+		ir.applyPolicy()
+		items[idx] = ir
+
+		res.Items[idx] = bulkItemResult{Method: br.Method, Path: br.Path, Host: br.Host, PolicyMet: ir.PolicyMet, Caches: ir.codes(), Stages: ir.Stages}
+	}
+
+	res.Status, res.PolicyMet = combinedStatus(items, group.Policy)
+	res.outcomes = items
+	return res
+}
+
+// bulkHandler serves POST /bulk, which broadcasts each of the
+// items found in the body and answers with the status code received
+// from each cache for each item.
+func bulkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	timeout, err := broadcastTimeout(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	items, err := parseBulkItems(r)
+	if err != nil {
+		http.Error(w, "Invalid bulk request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(items) == 0 {
+		http.Error(w, "No items to broadcast.", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		rs    bulkRoutes
+		fixed = r.Header.Get("X-Group")
+	)
+
+	// Unless X-Group names a group, each item goes to the groups
+	// serving its hosts.
+	for _, item := range items {
+		for _, host := range itemHosts(item, r) {
+			item.Host = host
+
+			var names = []string{fixed}
+			if fixed == "" {
+				if host == "" {
+					host = r.Host
+				}
+				if names, err = routeHost(host); err != nil {
+					sendToLogChannel(err.Error(), "\n")
+					http.Error(w, err.Error(), http.StatusNotFound)
+					return
+				}
+			}
+
+			for _, name := range names {
+				group, err := targetGroup(name)
+				if err != nil {
+					sendToLogChannel(err.Error(), "\n")
+					http.Error(w, err.Error(), http.StatusNotFound)
+					return
+				}
+
+				br, err := bulkRequest(item, r, group)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				rs.add(name, group, br)
+			}
+		}
+	}
+
+	if rs.caches() == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if isDryRun(r) {
+		writeBulkDryRun(w, r, &rs)
+		return
+	}
+
+	hooks, err := webhookUrls(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = guardBulk(r, &rs); err != nil {
+		sendToLogChannel("Rejected: ", err.Error(), "\n")
+		http.Error(w, err.Error(), http.StatusPreconditionRequired)
+		return
+	}
+
+	sendToLogChannel("Bulk broadcast of ", fmt.Sprint(rs.total), " items.\n")
+
+	var (
+		id      = newBroadcastId()
+		started = time.Now()
+	)
+
+	w.Header().Set("X-Broadcast-Id", id)
+
+	ctx, cancel := withTimeout(r.Context(), timeout)
+	defer cancel()
+
+	if stream := newProgressStream(w, r); stream != nil {
+		var failures int32
+
+		res, parts := broadcastRoutedBulk(ctx, &rs, func(route *bulkRoute, idx int, cr cacheResult) {
+			if cr.failed(route.group.Policy) {
+				atomic.AddInt32(&failures, 1)
+			}
+			br := route.reqs[idx]
+			stream.write("result", bulkProgress{Item: route.indexes[idx], Method: br.Method, Path: br.Path, Host: br.Host, cacheResult: cr})
+		})
+
+		stream.write("summary", bulkSummary{Status: res.Status, PolicyMet: res.PolicyMet, Items: len(res.Items), Failures: int(failures)})
+		auditRoutedBulk(id, r, &rs, started, parts)
+		if len(hooks) > 0 {
+			deliverWebhooks(hooks, newBulkWebhookPayload(id, r, &rs, started, time.Now(), res, parts))
+		}
+		return
+	}
+
+	res, parts := broadcastRoutedBulk(ctx, &rs, nil)
+	auditRoutedBulk(id, r, &rs, started, parts)
+	if len(hooks) > 0 {
+		deliverWebhooks(hooks, newBulkWebhookPayload(id, r, &rs, started, time.Now(), res, parts))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if res.PolicyMet != nil {
+		w.Header().Set("X-Policy-Met", strconv.FormatBool(*res.PolicyMet))
+	}
+	w.WriteHeader(res.Status)
+
+	out, _ := json.MarshalIndent(res, "", "  ")
+	w.Write(out)
+}
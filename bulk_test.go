@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+func TestParseBulkItems(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        []bulkItem
+		invalid     bool
+	}{
+		{
+			name: "lines",
+			body: "/a\n\n  /b?c=1  \n{\"path\": \"/d\", \"method\": \"BAN\", \"host\": \"example.com\"}\n",
+			want: []bulkItem{{Path: "/a"}, {Path: "/b?c=1"}, {Path: "/d", Method: "BAN", Host: "example.com"}},
+		},
+		{
+			name:        "array",
+			contentType: "application/json; charset=utf-8",
+			body:        `["/a", {"path": "/b", "hosts": ["a.com", "b.com"], "headers": {"X-Key": "1"}, "priority": "high"}]`,
+			want:        []bulkItem{{Path: "/a"}, {Path: "/b", Hosts: []string{"a.com", "b.com"}, Headers: map[string]string{"X-Key": "1"}, Priority: "high"}},
+		},
+		{name: "empty", body: "\n\n", want: nil},
+		{name: "broken line", body: "/a\n{\"path\": \n", invalid: true},
+		{name: "broken array", contentType: "application/json", body: `["/a",`, invalid: true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/bulk", strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+
+		items, err := parseBulkItems(r)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		got, _ := json.Marshal(items)
+		want, _ := json.Marshal(tt.want)
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got %s, want %s", tt.name, got, want)
+		}
+	}
+}
+
+func TestParseBulkItemsTooLarge(t *testing.T) {
+	body := strings.Repeat("/page\n", maxBulkBodySize/6+1)
+	r := httptest.NewRequest(http.MethodPost, "/bulk", strings.NewReader(body))
+
+	if _, err := parseBulkItems(r); err == nil {
+		t.Error("no error for a body over the limit")
+	}
+}
+
+func TestBulkRequest(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/bulk", nil)
+	r.Host = "broadcaster.example.com"
+
+	tests := []struct {
+		name    string
+		item    bulkItem
+		headers map[string]string
+		want    broadcastRequest
+		invalid bool
+	}{
+		{
+			name: "defaults",
+			item: bulkItem{Path: "/a?b=1"},
+			want: broadcastRequest{Method: "PURGE", Path: "/a", Query: "b=1", Host: "broadcaster.example.com", Priority: dao.PriorityLow},
+		},
+		{
+			name:    "method of the request",
+			item:    bulkItem{Path: "/a", Host: "www.example.com"},
+			headers: map[string]string{"X-Method": "BAN", "X-Priority": "high"},
+			want:    broadcastRequest{Method: "BAN", Path: "/a", Host: "www.example.com", Priority: dao.PriorityHigh},
+		},
+		{
+			name:    "item settings first",
+			item:    bulkItem{Path: "/a", Method: "SOFTPURGE", Priority: "normal"},
+			headers: map[string]string{"X-Method": "BAN", "X-Priority": "high"},
+			want:    broadcastRequest{Method: "SOFTPURGE", Path: "/a", Host: "broadcaster.example.com", Priority: dao.PriorityNormal},
+		},
+		{name: "relative path", item: bulkItem{Path: "a"}, invalid: true},
+		{name: "unknown priority", item: bulkItem{Path: "/a", Priority: "urgent"}, invalid: true},
+	}
+
+	for _, tt := range tests {
+		req := r.Clone(r.Context())
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+
+		br, err := bulkRequest(tt.item, req, testGroup())
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		if br.Method != tt.want.Method || br.Path != tt.want.Path || br.Query != tt.want.Query || br.Host != tt.want.Host || br.Priority != tt.want.Priority {
+			t.Errorf("%s: got %s %s?%s for %s at %s, want %s %s?%s for %s at %s", tt.name,
+				br.Method, br.Path, br.Query, br.Host, br.Priority,
+				tt.want.Method, tt.want.Path, tt.want.Query, tt.want.Host, tt.want.Priority)
+		}
+	}
+}
+
+func TestBulkConcurrency(t *testing.T) {
+	defer func(n int) { *bulkConcurrency = n }(*bulkConcurrency)
+	*bulkConcurrency = 2
+
+	var inFlight, most int32
+	cache := testCache(t, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+	})
+	other := testCache(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	useGroups(t, dao.Group{Name: "prod", Caches: []dao.Cache{cache, other}})
+
+	r := httptest.NewRequest(http.MethodPost, "/bulk", strings.NewReader("/1\n/2\n/3\n/4\n/5\n/6\n"))
+	r.Header.Set("X-Group", "prod")
+	w := httptest.NewRecorder()
+	bulkHandler(w, r)
+
+	if most := atomic.LoadInt32(&most); most > 2 {
+		t.Errorf("%d items handled at once against a cache, want 2 at most", most)
+	}
+
+	var res bulkResult
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Items) != 6 {
+		t.Fatalf("got %d items, want 6", len(res.Items))
+	}
+	for i, item := range res.Items {
+		if item.Caches[cache.Name] != http.StatusOK || item.Caches[other.Name] != http.StatusNotFound {
+			t.Errorf("item %d: got %v", i, item.Caches)
+		}
+	}
+}
+
+func TestBulkHandlerRejects(t *testing.T) {
+	useGroups(t, dao.Group{Name: "prod", Caches: []dao.Cache{{Name: "Cache1", Address: "http://127.0.0.1:1"}}})
+
+	tests := []struct {
+		method, group, body string
+		want                int
+	}{
+		{http.MethodGet, "prod", "/a", http.StatusMethodNotAllowed},
+		{http.MethodPost, "prod", "", http.StatusBadRequest},
+		{http.MethodPost, "prod", "{broken", http.StatusBadRequest},
+		{http.MethodPost, "prod", "relative", http.StatusBadRequest},
+		{http.MethodPost, "unknown", "/a", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/bulk", strings.NewReader(tt.body))
+		r.Header.Set("X-Group", tt.group)
+		w := httptest.NewRecorder()
+		bulkHandler(w, r)
+
+		if w.Code != tt.want {
+			t.Errorf("%s %q to %s: got a %d, want a %d", tt.method, tt.body, tt.group, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// clock tells the time and runs timers. Scheduled broadcasts rely
+// on it so that tests can drive them with a fake clock.
+type clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) clockTimer
+}
+
+type clockTimer interface {
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	return time.AfterFunc(d, f)
+}
+
+// fakeClock only moves forward when told to, running the timers
+// which are due on the way.
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	at    time.Time
+	f     func()
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	c.lock.Lock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	c.lock.Unlock()
+
+	if d <= 0 {
+		go c.Advance(0)
+	}
+	return t
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	for i, other := range t.clock.timers {
+		if other == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Advance moves the clock forward and runs the timers which are
+// due, in the order they are due, including the ones armed on the
+// way by the timers run.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	c.now = c.now.Add(d)
+	c.lock.Unlock()
+
+	for {
+		c.lock.Lock()
+		var due, pending []*fakeTimer
+		for _, t := range c.timers {
+			if t.at.After(c.now) {
+				pending = append(pending, t)
+			} else {
+				due = append(due, t)
+			}
+		}
+		c.timers = pending
+		c.lock.Unlock()
+
+		if len(due) == 0 {
+			return
+		}
+
+		sort.SliceStable(due, func(i, j int) bool {
+			return due[i].at.Before(due[j].at)
+		})
+
+		for _, t := range due {
+			t.f()
+		}
+	}
+}
+
+// clockHandler serves /clock when the fake clock is enabled. GET
+// returns the time of the clock and POST moves it forward by the
+// duration given with the advance parameter.
+func clockHandler(w http.ResponseWriter, r *http.Request) {
+	fake := schedulerClock.(*fakeClock)
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		d, err := time.ParseDuration(r.URL.Query().Get("advance"))
+		if err != nil || d < 0 {
+			http.Error(w, "Invalid advance, expected a duration such as 90s.", http.StatusBadRequest)
+			return
+		}
+		fake.Advance(d)
+	default:
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	out, _ := json.MarshalIndent(map[string]time.Time{"now": fake.Now().UTC()}, "", "  ")
+	w.Write(out)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// coalesceIgnoredHeaders lists the headers which vary from client
+// to client without changing what a broadcast does, they are left
+// out when deciding whether two requests are identical.
+var coalesceIgnoredHeaders = map[string]bool{
+	"Accept":          true,
+	"Accept-Encoding": true,
+	"Connection":      true,
+	"Content-Length":  true,
+	"Keep-Alive":      true,
+	"User-Agent":      true,
+	"X-Async":         true,
+	"X-Callback-Url":  true,
+	"X-Forwarded-For": true,
+	"X-Real-Ip":       true,
+	"X-Request-Id":    true,
+}
+
+// flight is a broadcast currently being fanned out. Every identical
+// request arriving before it completes waits on done and shares
+// its outcome instead of triggering a fan-out of its own.
+//
+// A flight is canceled once all the requests waiting on it are gone.
+type flight struct {
+	done    chan struct{}
+	res     *broadcastResult
+	waiters int
+	cancel  context.CancelFunc
+}
+
+var (
+	flightsLocker sync.Mutex
+	flights       = make(map[string]*flight)
+)
+
+// wait blocks until the flight completes, and reports whether it
+// did. Should ctx be done beforehand, the request is no longer
+// counted as waiting and leaves without the outcome.
+func (f *flight) wait(ctx context.Context, key string) bool {
+	select {
+	case <-f.done:
+		return true
+	case <-ctx.Done():
+	}
+
+	flightsLocker.Lock()
+	if f.waiters--; f.waiters == 0 {
+		f.cancel()
+
+		// Later requests must not join a canceled flight.
+		if flights[key] == f {
+			delete(flights, key)
+		}
+	}
+	flightsLocker.Unlock()
+
+	return false
+}
+
+// coalesceKey identifies a broadcast by its group, method, path,
+// query, relevant headers and body.
+func coalesceKey(groupName string, r *http.Request, body *requestBody) string {
+	var (
+		key     strings.Builder
+		headers []string
+	)
+
+	for k := range r.Header {
+		if !coalesceIgnoredHeaders[k] {
+			headers = append(headers, k)
+		}
+	}
+	sort.Strings(headers)
+
+	key.WriteString(groupName)
+	key.WriteString("\n")
+	key.WriteString(r.Method)
+	key.WriteString(" ")
+	key.WriteString(r.Host)
+	key.WriteString(r.URL.Path)
+	key.WriteString("?")
+	key.WriteString(r.URL.RawQuery)
+
+	for _, h := range headers {
+		key.WriteString("\n")
+		key.WriteString(h)
+		key.WriteString(": ")
+		key.WriteString(strings.Join(r.Header[h], ", "))
+	}
+
+	if body != nil {
+		key.WriteString("\n\n")
+		key.WriteString(body.sum)
+	}
+
+	return key.String()
+}
+
+// coalesce runs fn unless an identical broadcast is already in
+// flight, in which case it waits for that one and returns its
+// outcome. The second return value reports whether the outcome
+// was shared with another request. No outcome is returned if ctx
+// is done before the flight completes.
+//
+// fn is given a context of its own, which does not end with ctx
+// since other requests may be waiting on the same flight.
+//
+// The first request of a flight waits for the debounce window,
+// if any, before running fn so that identical requests arriving
+// shortly after can join it.
+func coalesce(ctx context.Context, key string, fn func(context.Context) *broadcastResult) (*broadcastResult, bool) {
+	flightsLocker.Lock()
+	if f, found := flights[key]; found {
+		f.waiters++
+		flightsLocker.Unlock()
+
+		if !f.wait(ctx, key) {
+			return nil, true
+		}
+		return f.res, true
+	}
+
+	fctx, cancel := context.WithCancel(context.Background())
+
+	f := &flight{done: make(chan struct{}), waiters: 1, cancel: cancel}
+	flights[key] = f
+	flightsLocker.Unlock()
+
+	// The flight carries on for the other requests should this
+	// one leave.
+	go func() {
+		defer cancel()
+
+		if *coalesceWindow > 0 {
+			select {
+			case <-time.After(*coalesceWindow):
+			case <-fctx.Done():
+			}
+		}
+
+		f.res = fn(fctx)
+
+		flightsLocker.Lock()
+		if flights[key] == f {
+			delete(flights, key)
+		}
+		flightsLocker.Unlock()
+		close(f.done)
+	}()
+
+	if !f.wait(ctx, key) {
+		return nil, false
+	}
+	return f.res, false
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+func TestCoalesceSharesTheBroadcast(t *testing.T) {
+	var (
+		hits    int32
+		release = make(chan struct{})
+	)
+
+	cache := testCache(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-release
+	})
+	group := testGroup(cache)
+	br := broadcastRequest{Method: "PURGE", Path: "/shared", Host: "example.com"}
+
+	var (
+		wg     sync.WaitGroup
+		shared = make([]bool, 3)
+		status = make([]int, 3)
+	)
+
+	for i := range shared {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			res, s := coalesce(context.Background(), "shared", func(ctx context.Context) *broadcastResult {
+				return broadcast(ctx, br, group, nil)
+			})
+			shared[i], status[i] = s, res.Caches[0].Status
+		}(i)
+
+		// The first request must be in flight before the others.
+		if i == 0 {
+			for atomic.LoadInt32(&hits) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if hits := atomic.LoadInt32(&hits); hits != 1 {
+		t.Errorf("cache hit %d times, want 1", hits)
+	}
+	if shared[0] || !shared[1] || !shared[2] {
+		t.Errorf("shared = %v, want only the followers to share", shared)
+	}
+	for i, s := range status {
+		if s != http.StatusOK {
+			t.Errorf("request %d got status %d, want 200", i, s)
+		}
+	}
+}
+
+func TestCoalesceCancelsOnceTheLastWaiterLeaves(t *testing.T) {
+	var (
+		started  = make(chan struct{})
+		canceled = make(chan struct{})
+		done     = make(chan struct{}, 2)
+	)
+
+	fn := func(ctx context.Context) *broadcastResult {
+		close(started)
+		<-ctx.Done()
+		close(canceled)
+		return &broadcastResult{Status: http.StatusGatewayTimeout}
+	}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+
+	go func() {
+		coalesce(ctx1, "leaving", fn)
+		done <- struct{}{}
+	}()
+	<-started
+
+	go func() {
+		coalesce(ctx2, "leaving", fn)
+		done <- struct{}{}
+	}()
+
+	// Wait for the second request to join the flight.
+	for {
+		flightsLocker.Lock()
+		waiters := flights["leaving"].waiters
+		flightsLocker.Unlock()
+		if waiters == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel1()
+	select {
+	case <-canceled:
+		t.Fatal("flight canceled while a request still waits on it")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel2()
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("flight not canceled once every request left")
+	}
+
+	<-done
+	<-done
+
+	flightsLocker.Lock()
+	defer flightsLocker.Unlock()
+	if _, found := flights["leaving"]; found {
+		t.Error("canceled flight still joinable")
+	}
+}
+
+func TestCoalesceWindow(t *testing.T) {
+	defer func(window time.Duration) { *coalesceWindow = window }(*coalesceWindow)
+	*coalesceWindow = 100 * time.Millisecond
+
+	var (
+		calls int32
+		ran   = make(chan time.Time, 2)
+		wg    sync.WaitGroup
+		start = time.Now()
+	)
+
+	fn := func(ctx context.Context) *broadcastResult {
+		atomic.AddInt32(&calls, 1)
+		ran <- time.Now()
+		return &broadcastResult{Status: http.StatusOK}
+	}
+
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			coalesce(context.Background(), "window", fn)
+		}()
+		time.Sleep(30 * time.Millisecond)
+	}
+	wg.Wait()
+
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("fn called %d times, want 1", calls)
+	}
+	if elapsed := (<-ran).Sub(start); elapsed < *coalesceWindow {
+		t.Errorf("fn ran after %s, before the %s window", elapsed, *coalesceWindow)
+	}
+}
+
+func TestCoalesceCanceledFollowerReturns(t *testing.T) {
+	var (
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+
+	fn := func(ctx context.Context) *broadcastResult {
+		close(started)
+		<-release
+		return &broadcastResult{Status: http.StatusOK}
+	}
+
+	leader := make(chan *broadcastResult)
+	go func() {
+		res, _ := coalesce(context.Background(), "follower", fn)
+		leader <- res
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	begin := time.Now()
+	res, shared := coalesce(ctx, "follower", fn)
+	if elapsed := time.Since(begin); elapsed > 500*time.Millisecond {
+		t.Errorf("the canceled follower returned after %s", elapsed)
+	}
+	if res != nil || !shared {
+		t.Errorf("got %v, %v, want no outcome of a shared flight", res, shared)
+	}
+
+	// The flight carries on for the leader.
+	close(release)
+	if res := <-leader; res == nil || res.Status != http.StatusOK {
+		t.Errorf("leader got %v, want the outcome of the flight", res)
+	}
+}
+
+func TestUnfinishedRoutes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	routes := []groupRoute{
+		{name: "a", group: testGroup(dao.Cache{Name: "Cache1"}, dao.Cache{Name: "Cache2"})},
+		{name: "b", group: dao.Group{Name: "b", Caches: []dao.Cache{{Name: "Cache3"}}, Policy: dao.DefaultPolicy()}},
+	}
+
+	res := unfinishedRoutes(ctx, routes)
+	if len(res.Caches) != 3 || len(res.parts) != 2 {
+		t.Fatalf("got %d caches in %d parts, want 3 in 2", len(res.Caches), len(res.parts))
+	}
+	for _, cr := range res.Caches {
+		if cr.Error != "canceled" {
+			t.Errorf("%s: got the error %q, want canceled", cr.Name, cr.Error)
+		}
+	}
+	if res.PolicyMet == nil || *res.PolicyMet {
+		t.Errorf("got the policy met %v, want false", res.PolicyMet)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+const (
+	cronSuccess = "success"
+	cronFailure = "failure"
+	cronSkipped = "skipped"
+)
+
+// cronJob runs a recurring broadcast configured for a group. Its
+// counters are kept across configuration reloads.
+type cronJob struct {
+	group    string
+	settings *dao.CronSettings
+
+	// The time the next run is due, before any jitter, and the
+	// timer waiting for it. Timers of an older generation, armed
+	// before a reload, are ignored if they fire.
+	next       time.Time
+	timer      clockTimer
+	generation int
+
+	running    int
+	cancel     context.CancelFunc
+	lastRun    *time.Time
+	lastStatus int
+	outcomes   map[string]int64
+}
+
+// cronStatus is the state of a recurring broadcast as shown by
+// the API.
+type cronStatus struct {
+	Group      string           `json:"group"`
+	Name       string           `json:"name"`
+	Schedule   string           `json:"schedule"`
+	Method     string           `json:"method"`
+	Path       string           `json:"path"`
+	Overlap    string           `json:"overlap"`
+	Next       time.Time        `json:"next"`
+	Running    int              `json:"running"`
+	LastRun    *time.Time       `json:"last_run,omitempty"`
+	LastStatus int              `json:"last_status,omitempty"`
+	Runs       map[string]int64 `json:"runs"`
+}
+
+var (
+	cronsLocker  sync.Mutex
+	crons        = make(map[string]*cronJob)
+	cronsStopped bool
+
+	// Seeded apart so that several broadcasters sharing the same
+	// configuration get different jitters. Guarded by cronsLocker.
+	cronJitter = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func cronKey(groupName, name string) string {
+	return groupName + "/" + name
+}
+
+// setUpCrons arms the recurring broadcasts of every group, after
+// the configuration has been loaded or reloaded. Runs in flight
+// carry on.
+func setUpCrons() {
+	locker.Lock()
+	var configured = make(map[string]*cronJob)
+	for _, g := range groups {
+		for _, c := range g.Crons {
+			configured[cronKey(g.Name, c.Name)] = &cronJob{group: g.Name, settings: c}
+		}
+	}
+	locker.Unlock()
+
+	cronsLocker.Lock()
+	defer cronsLocker.Unlock()
+
+	for key, cj := range crons {
+		cj.timer.Stop()
+		cj.generation++
+
+		if _, found := configured[key]; !found {
+			delete(crons, key)
+		}
+	}
+
+	for key, c := range configured {
+		cj, found := crons[key]
+		if !found {
+			cj = c
+			cj.outcomes = make(map[string]int64)
+			crons[key] = cj
+		}
+		cj.settings = c.settings
+
+		armCron(cj, schedulerClock.Now())
+	}
+}
+
+// armCron sets the timer of the first run due after from. The
+// caller must hold cronsLocker.
+func armCron(cj *cronJob, from time.Time) {
+	cj.next = cj.settings.Spec.Next(from)
+
+	var delay = cj.next.Sub(schedulerClock.Now())
+	if cj.settings.Jitter > 0 {
+		delay += time.Duration(cronJitter.Int63n(int64(cj.settings.Jitter)))
+	}
+
+	var generation = cj.generation
+	cj.timer = schedulerClock.AfterFunc(delay, func() {
+		fireCron(cj, generation)
+	})
+}
+
+// fireCron starts a run of the recurring broadcast, unless the
+// overlap policy says otherwise, and arms the following one.
+func fireCron(cj *cronJob, generation int) {
+	cronsLocker.Lock()
+	defer cronsLocker.Unlock()
+
+	if cronsStopped || generation != cj.generation {
+		return
+	}
+
+	var (
+		key      = cronKey(cj.group, cj.settings.Name)
+		settings = cj.settings
+	)
+
+	// The following run is due relatively to this one, so that
+	// the jitter doesn't add up.
+	armCron(cj, cj.next)
+
+	if cj.running > 0 {
+		switch settings.Overlap {
+		case dao.OverlapSkip:
+			cj.outcomes[cronSkipped]++
+			sendToLogChannel("Cron ", key, " skipped, the previous run is still in flight.\n")
+			return
+		case dao.OverlapReplace:
+			cj.cancel()
+			sendToLogChannel("Cron ", key, " replaces the previous run still in flight.\n")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cj.cancel = cancel
+	cj.running++
+
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		defer cancel()
+
+		runCron(ctx, cj, key, settings)
+	}()
+}
+
+// runCron broadcasts the request of the recurring broadcast and
+// records its outcome.
+func runCron(ctx context.Context, cj *cronJob, key string, settings *dao.CronSettings) {
+	var status int
+
+	defer func() {
+		finished := schedulerClock.Now()
+
+		cronsLocker.Lock()
+		defer cronsLocker.Unlock()
+
+		cj.running--
+		cj.lastRun = &finished
+		cj.lastStatus = status
+	}()
+
+	group, err := targetGroup(cj.group)
+	if err != nil {
+		cronOutcome(cj, cronFailure)
+		sendToLogChannel("Cron ", key, " failed: ", err.Error(), "\n")
+		return
+	}
+
+	br := broadcastRequest{
+		Method:   settings.Method,
+		Path:     settings.Path,
+		Host:     settings.Host,
+		Headers:  make(http.Header),
+		Priority: settings.Priority,
+	}
+
+	if i := strings.Index(settings.Path, "?"); i != -1 {
+		br.Path, br.Query = settings.Path[:i], settings.Path[i+1:]
+	}
+
+	if err = applyIntent(&br, settings.Intent, settings.Keys, group); err != nil {
+		cronOutcome(cj, cronFailure)
+		sendToLogChannel("Cron ", key, " failed: ", err.Error(), "\n")
+		return
+	}
+
+	if br.Priority == "" && group.Priority != nil {
+		br.Priority = group.Priority.Of(br.Method)
+	}
+	if br.Priority == "" {
+		br.Priority = dao.PriorityNormal
+	}
+
+	ctx, cancel := withTimeout(ctx, settings.Timeout)
+	defer cancel()
+
+	sendToLogChannel("Cron ", key, " running ", br.Method, " ", settings.Path, ".\n")
+
+	var (
+		id      = newBroadcastId()
+		started = time.Now()
+	)
+
+	res := broadcast(ctx, br, group, nil)
+	status = res.Status
+
+	rec := newAuditRecord(id, nil, cj.group, br, group, started, res.Status, res.Caches)
+	rec.Identity = "cron:" + key
+	writeAudit(rec)
+
+	if hooks := splitUrls(*webhooks); len(hooks) > 0 {
+		deliverWebhooks(hooks, newWebhookPayload(id, br.Method, br.Path, cj.group, started, time.Now(), res))
+	}
+
+	var succeeded = len(res.failures()) == 0
+	if res.PolicyMet != nil {
+		succeeded = *res.PolicyMet
+	}
+
+	if succeeded {
+		cronOutcome(cj, cronSuccess)
+	} else {
+		cronOutcome(cj, cronFailure)
+	}
+
+	sendToLogChannel("Cron ", key, " done with a ", strconv.Itoa(res.Status), ", ", strconv.Itoa(len(res.failures())), " caches failed.\n")
+}
+
+func cronOutcome(cj *cronJob, outcome string) {
+	cronsLocker.Lock()
+	cj.outcomes[outcome]++
+	cronsLocker.Unlock()
+}
+
+// stopCrons keeps the recurring broadcasts from running again.
+func stopCrons() {
+	cronsLocker.Lock()
+	defer cronsLocker.Unlock()
+
+	cronsStopped = true
+	for _, cj := range crons {
+		cj.timer.Stop()
+	}
+}
+
+func cronStatuses() []cronStatus {
+	cronsLocker.Lock()
+	var statuses = make([]cronStatus, 0, len(crons))
+	for _, cj := range crons {
+		st := cronStatus{
+			Group:      cj.group,
+			Name:       cj.settings.Name,
+			Schedule:   cj.settings.Schedule,
+			Method:     cj.settings.Method,
+			Path:       cj.settings.Path,
+			Overlap:    cj.settings.Overlap,
+			Next:       cj.next,
+			Running:    cj.running,
+			LastRun:    cj.lastRun,
+			LastStatus: cj.lastStatus,
+			Runs:       make(map[string]int64, len(cj.outcomes)),
+		}
+		for outcome, count := range cj.outcomes {
+			st.Runs[outcome] = count
+		}
+		statuses = append(statuses, st)
+	}
+	cronsLocker.Unlock()
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return cronKey(statuses[i].Group, statuses[i].Name) < cronKey(statuses[j].Group, statuses[j].Name)
+	})
+
+	return statuses
+}
+
+// cronsHandler serves GET /crons, which returns the state of the
+// recurring broadcasts.
+func cronsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	out, _ := json.MarshalIndent(cronStatuses(), "", "  ")
+	w.Write(out)
+}
+
+func writeCronMetrics(w io.Writer) {
+	var statuses = cronStatuses()
+
+	fmt.Fprintln(w, "# HELP broadcaster_cron_runs_total Number of runs of a recurring broadcast, per outcome.")
+	fmt.Fprintln(w, "# TYPE broadcaster_cron_runs_total counter")
+	for _, st := range statuses {
+		for _, outcome := range []string{cronSuccess, cronFailure, cronSkipped} {
+			fmt.Fprintf(w, "broadcaster_cron_runs_total{group=%s,name=%s,outcome=%s} %d\n", metricLabel(st.Group), metricLabel(st.Name), metricLabel(outcome), st.Runs[outcome])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP broadcaster_cron_last_status Status code the last run of a recurring broadcast ended with.")
+	fmt.Fprintln(w, "# TYPE broadcaster_cron_last_status gauge")
+	for _, st := range statuses {
+		fmt.Fprintf(w, "broadcaster_cron_last_status{group=%s,name=%s} %d\n", metricLabel(st.Group), metricLabel(st.Name), st.LastStatus)
+	}
+
+	fmt.Fprintln(w, "# HELP broadcaster_cron_next_run_timestamp_seconds Time the next run of a recurring broadcast is due.")
+	fmt.Fprintln(w, "# TYPE broadcaster_cron_next_run_timestamp_seconds gauge")
+	for _, st := range statuses {
+		fmt.Fprintf(w, "broadcaster_cron_next_run_timestamp_seconds{group=%s,name=%s} %d\n", metricLabel(st.Group), metricLabel(st.Name), st.Next.Unix())
+	}
+}
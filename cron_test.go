@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+// cronState returns the number of runs of the recurring broadcast
+// in flight and its outcome counters.
+func cronState(cj *cronJob) (int, map[string]int64) {
+	cronsLocker.Lock()
+	defer cronsLocker.Unlock()
+
+	outcomes := make(map[string]int64, len(cj.outcomes))
+	for k, v := range cj.outcomes {
+		outcomes[k] = v
+	}
+	return cj.running, outcomes
+}
+
+func waitForCron(t *testing.T, cj *cronJob, running int) map[string]int64 {
+	t.Helper()
+
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		n, outcomes := cronState(cj)
+		if n == running {
+			return outcomes
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d runs in flight, want %d", n, running)
+		}
+	}
+}
+
+func TestCronOverlap(t *testing.T) {
+	clock := schedulerClock
+	defer func() { schedulerClock = clock }()
+
+	tests := []struct {
+		overlap string
+		// Runs in flight once the second one is due, and the
+		// outcomes counted before the cache answers.
+		running  int
+		outcomes map[string]int64
+	}{
+		{dao.OverlapSkip, 1, map[string]int64{cronSkipped: 1}},
+		{dao.OverlapAllow, 2, map[string]int64{}},
+		{dao.OverlapReplace, 1, map[string]int64{cronFailure: 1}},
+	}
+
+	for _, tt := range tests {
+		var (
+			hits    = make(chan struct{}, 4)
+			release = make(chan struct{})
+			fake    = newFakeClock(time.Now())
+		)
+		schedulerClock = fake
+
+		cache := testCache(t, func(w http.ResponseWriter, r *http.Request) {
+			hits <- struct{}{}
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		})
+
+		groupName := "cron-" + tt.overlap
+		locker.Lock()
+		groups[groupName] = dao.Group{Name: groupName, Caches: []dao.Cache{cache}}
+		locker.Unlock()
+
+		spec, _ := dao.ParseCronSchedule("@every 1m")
+		cj := &cronJob{
+			group: groupName,
+			settings: &dao.CronSettings{
+				Name:     "overlap",
+				Schedule: "@every 1m",
+				Method:   "PURGE",
+				Path:     "/",
+				Overlap:  tt.overlap,
+				Spec:     spec,
+			},
+			outcomes: make(map[string]int64),
+		}
+
+		cronsLocker.Lock()
+		armCron(cj, fake.Now())
+		cronsLocker.Unlock()
+
+		fake.Advance(time.Minute)
+		<-hits
+		fake.Advance(time.Minute)
+
+		outcomes := waitForCron(t, cj, tt.running)
+		if tt.overlap != dao.OverlapSkip {
+			<-hits
+		}
+		if len(outcomes) != len(tt.outcomes) {
+			t.Errorf("%s: got the outcomes %v, want %v", tt.overlap, outcomes, tt.outcomes)
+		}
+		for k, v := range tt.outcomes {
+			if outcomes[k] != v {
+				t.Errorf("%s: got the outcomes %v, want %v", tt.overlap, outcomes, tt.outcomes)
+			}
+		}
+
+		close(release)
+		waitForCron(t, cj, 0)
+
+		cronsLocker.Lock()
+		cj.timer.Stop()
+		cronsLocker.Unlock()
+
+		locker.Lock()
+		delete(groups, groupName)
+		locker.Unlock()
+	}
+}
@@ -0,0 +1,76 @@
+package dao
+
+import (
+	"fmt"
+	"time"
+
+	ini "github.com/wearephenix/varnish-broadcaster/ini"
+)
+
+// BreakerSettings configure the circuit breaker of each cache of
+// a group. The circuit opens once the failure rate over the window
+// reaches the threshold, and is half-opened after the cooldown to
+// let a few probing requests through.
+type BreakerSettings struct {
+	Window      time.Duration `json:"window"`
+	MinRequests int           `json:"min_requests"`
+	FailureRate float64       `json:"failure_rate"`
+	Cooldown    time.Duration `json:"cooldown"`
+	Probes      int           `json:"probes"`
+}
+
+// MinBreakerWindow is the shortest window failures are counted
+// over, it is split into buckets of at least 100ms.
+const MinBreakerWindow = time.Second
+
+func DefaultBreakerSettings() *BreakerSettings {
+	return &BreakerSettings{
+		Window:      30 * time.Second,
+		MinRequests: 5,
+		FailureRate: 0.5,
+		Cooldown:    10 * time.Second,
+		Probes:      1,
+	}
+}
+
+// loadBreakerSettings reads the breaker settings out of a
+// [group.breaker] section, any missing key keeping its default
+// value.
+func loadBreakerSettings(s *ini.Section) (*BreakerSettings, error) {
+	var (
+		b   = DefaultBreakerSettings()
+		err error
+	)
+
+	if s.HasKey("window") {
+		if b.Window, err = s.Key("window").Duration(); err != nil || b.Window < MinBreakerWindow {
+			return nil, fmt.Errorf("invalid window %q, expected at least %s", s.Key("window").String(), MinBreakerWindow)
+		}
+	}
+
+	if s.HasKey("min-requests") {
+		if b.MinRequests, err = s.Key("min-requests").Int(); err != nil || b.MinRequests < 1 {
+			return nil, fmt.Errorf("invalid min-requests %q", s.Key("min-requests").String())
+		}
+	}
+
+	if s.HasKey("failure-rate") {
+		if b.FailureRate, err = s.Key("failure-rate").Float64(); err != nil || b.FailureRate <= 0 || b.FailureRate > 1 {
+			return nil, fmt.Errorf("invalid failure-rate %q, expected a number between 0 and 1", s.Key("failure-rate").String())
+		}
+	}
+
+	if s.HasKey("cooldown") {
+		if b.Cooldown, err = s.Key("cooldown").Duration(); err != nil || b.Cooldown < 0 {
+			return nil, fmt.Errorf("invalid cooldown %q", s.Key("cooldown").String())
+		}
+	}
+
+	if s.HasKey("probes") {
+		if b.Probes, err = s.Key("probes").Int(); err != nil || b.Probes < 1 {
+			return nil, fmt.Errorf("invalid probes %q", s.Key("probes").String())
+		}
+	}
+
+	return b, nil
+}
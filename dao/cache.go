@@ -2,9 +2,11 @@ package dao
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
 
 	ini "github.com/wearephenix/varnish-broadcaster/ini"
 )
@@ -15,12 +17,143 @@ type Cache struct {
 	Method     string      `json:"-"`
 	Item       string      `json:"-"`
 	Parameters string      `json:"-"`
+	Host       string      `json:"-"`
 	Headers    http.Header `json:"-"`
+
+	// Settings of the group the cache belongs to.
+	Retry   *RetryPolicy     `json:"-"`
+	Breaker *BreakerSettings `json:"-"`
+	Queue   *QueueSettings   `json:"-"`
+	Rewrite *RewriteRules    `json:"-"`
+	Forward *HeaderPolicy    `json:"-"`
 }
 
 type Group struct {
-	Name   string  `json:"name"`
-	Caches []Cache `json:"caches"`
+	Name     string             `json:"name"`
+	Caches   []Cache            `json:"caches"`
+	Policy   *Policy            `json:"policy,omitempty"`
+	Retry    *RetryPolicy       `json:"retry,omitempty"`
+	Breaker  *BreakerSettings   `json:"breaker,omitempty"`
+	Queue    *QueueSettings     `json:"queue,omitempty"`
+	Priority *PrioritySettings  `json:"priority,omitempty"`
+	Crons    []*CronSettings    `json:"crons,omitempty"`
+	Stages   []Stage            `json:"stages,omitempty"`
+	Intents  map[string]*Intent `json:"intents,omitempty"`
+	Rewrite  *RewriteRules      `json:"rewrite,omitempty"`
+	Forward  *HeaderPolicy      `json:"headers,omitempty"`
+	Hosts    []string           `json:"hosts,omitempty"`
+}
+
+// settingLoaders read the settings of a group out of the sections
+// named after the group followed by the kind of setting, such as
+// [prod.policy].
+var settingLoaders = map[string]func(*Group, *ini.Section) error{
+	"policy": func(g *Group, s *ini.Section) (err error) {
+		g.Policy, err = loadPolicy(s)
+		return err
+	},
+	"retry": func(g *Group, s *ini.Section) (err error) {
+		if g.Retry, err = loadRetryPolicy(s); err != nil {
+			return err
+		}
+		for i := range g.Caches {
+			g.Caches[i].Retry = g.Retry
+		}
+		return nil
+	},
+	"breaker": func(g *Group, s *ini.Section) (err error) {
+		if g.Breaker, err = loadBreakerSettings(s); err != nil {
+			return err
+		}
+		for i := range g.Caches {
+			g.Caches[i].Breaker = g.Breaker
+		}
+		return nil
+	},
+	"cron": func(g *Group, s *ini.Section) error {
+		name := s.Name()[strings.LastIndex(s.Name(), ".")+1:]
+
+		c, err := loadCronSettings(name, s)
+		if err != nil {
+			return err
+		}
+		g.Crons = append(g.Crons, c)
+		return nil
+	},
+	"priority": func(g *Group, s *ini.Section) (err error) {
+		g.Priority, err = loadPrioritySettings(s)
+		return err
+	},
+	"intents": func(g *Group, s *ini.Section) (err error) {
+		g.Intents, err = loadIntents(s)
+		return err
+	},
+	"headers": func(g *Group, s *ini.Section) (err error) {
+		if g.Forward, err = loadHeaderPolicy(s); err != nil {
+			return err
+		}
+		for i := range g.Caches {
+			g.Caches[i].Forward = g.Forward
+		}
+		return nil
+	},
+	"hosts": func(g *Group, s *ini.Section) (err error) {
+		g.Hosts, err = loadHostNames(s)
+		return err
+	},
+	"rewrite": func(g *Group, s *ini.Section) (err error) {
+		if g.Rewrite, err = loadRewriteRules(s); err != nil {
+			return err
+		}
+		for i := range g.Caches {
+			g.Caches[i].Rewrite = g.Rewrite
+		}
+		return nil
+	},
+	"stages": func(g *Group, s *ini.Section) (err error) {
+		g.Stages, err = loadStages(g, s)
+		return err
+	},
+	"queue": func(g *Group, s *ini.Section) (err error) {
+		if g.Queue, err = loadQueueSettings(s); err != nil {
+			return err
+		}
+		for i := range g.Caches {
+			g.Caches[i].Queue = g.Queue
+		}
+		return nil
+	},
+}
+
+// namedSettings are the kinds of setting a group may have several
+// of, each section being named after the kind followed by a name of
+// its own, such as [prod.cron.nightly].
+var namedSettings = map[string]bool{
+	"cron": true,
+}
+
+// settingSection splits the name of a settings section into the
+// group it applies to and the kind of setting. Any other section
+// is a group of its own.
+func settingSection(name string) (string, string, bool) {
+	i := strings.LastIndex(name, ".")
+	if i == -1 {
+		return "", "", false
+	}
+
+	if kind := name[i+1:]; !namedSettings[kind] {
+		if _, found := settingLoaders[kind]; found {
+			return name[:i], kind, true
+		}
+	}
+
+	// Named settings, the kind comes before the name.
+	j := strings.LastIndex(name[:i], ".")
+	if j == -1 || !namedSettings[name[j+1:i]] {
+		return "", "", false
+	}
+
+	return name[:j], name[j+1 : i], true
 }
 
 func LoadCachesFromJson(configPath string) ([]Group, error) {
@@ -49,7 +182,23 @@ func LoadCachesFromIni(configPath string) ([]Group, error) {
 		return groups, err
 	}
 
+	// A section named like settings is a group of its own unless
+	// the group it would apply to exists, e.g. [eu.headers] without
+	// any [eu] section.
+	var sections = make(map[string]bool)
 	for _, s := range cfg.Sections() {
+		sections[s.Name()] = true
+	}
+
+	isSettings := func(name string) (string, string, bool) {
+		groupName, kind, found := settingSection(name)
+		return groupName, kind, found && sections[groupName]
+	}
+
+	for _, s := range cfg.Sections() {
+		if _, _, found := isSettings(s.Name()); found {
+			continue
+		}
 
 		var g Group
 
@@ -64,5 +213,30 @@ func LoadCachesFromIni(configPath string) ([]Group, error) {
 		groups = append(groups, g)
 	}
 
+	for _, s := range cfg.Sections() {
+		groupName, kind, found := isSettings(s.Name())
+		if !found {
+			continue
+		}
+
+		g := findGroup(groups, groupName)
+		if g == nil {
+			return groups, fmt.Errorf("[%s]: %s is not a group", s.Name(), groupName)
+		}
+
+		if err = settingLoaders[kind](g, s); err != nil {
+			return groups, fmt.Errorf("[%s]: %s", s.Name(), err.Error())
+		}
+	}
+
 	return groups, nil
 }
+
+func findGroup(groups []Group, name string) *Group {
+	for i := range groups {
+		if groups[i].Name == name {
+			return &groups[i]
+		}
+	}
+	return nil
+}
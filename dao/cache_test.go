@@ -0,0 +1,78 @@
+package dao
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// loadTestConfig loads the groups out of an ini configuration.
+func loadTestConfig(t *testing.T, content string) ([]Group, error) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "caches.ini")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadCachesFromIni(path)
+}
+
+func TestSettingsSections(t *testing.T) {
+	groups, err := loadTestConfig(t, `
+[eu]
+Cache1 = http://127.0.0.1:7001
+
+[eu.policy]
+require = all
+
+[us.headers]
+Cache2 = http://127.0.0.1:7002
+
+[cdn.retry]
+Cache3 = http://127.0.0.1:7003
+
+[cdn.retry.policy]
+require = quorum
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names = make(map[string]*Group)
+	for i := range groups {
+		names[groups[i].Name] = &groups[i]
+	}
+
+	if g := names["eu"]; g == nil || g.Policy == nil {
+		t.Errorf("[eu.policy] not applied to eu: %+v", g)
+	}
+	if _, found := names["eu.policy"]; found {
+		t.Error("[eu.policy] loaded as a group")
+	}
+
+	for _, name := range []string{"us.headers", "cdn.retry"} {
+		g := names[name]
+		if g == nil || len(g.Caches) != 1 {
+			t.Errorf("[%s] without its group not loaded as a group: %+v", name, g)
+		}
+	}
+	if g := names["cdn.retry"]; g == nil || g.Policy == nil || g.Policy.Require != RequireQuorum {
+		t.Errorf("[cdn.retry.policy] not applied to cdn.retry: %+v", g)
+	}
+}
+
+func TestBreakerWindow(t *testing.T) {
+	for _, window := range []string{"5ns", "999ms", "0", "-1s"} {
+		if _, err := loadTestConfig(t, "[prod]\nCache1 = http://127.0.0.1:7001\n[prod.breaker]\nwindow = "+window+"\n"); err == nil {
+			t.Errorf("window %s accepted", window)
+		}
+	}
+
+	if _, err := loadTestConfig(t, "[prod]\nCache1 = http://127.0.0.1:7001\n[prod.breaker]\nwindow = 1s\n"); err != nil {
+		t.Errorf("window 1s refused: %v", err)
+	}
+
+	if _, err := loadTestConfig(t, "[prod]\nCache1 = http://127.0.0.1:7001\n[prod.breaker]\ncooldown = -1s\n"); err == nil {
+		t.Error("negative cooldown accepted")
+	}
+}
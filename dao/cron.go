@@ -0,0 +1,279 @@
+package dao
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	ini "github.com/wearephenix/varnish-broadcaster/ini"
+)
+
+// What happens when a recurring broadcast is due while its
+// previous run is still in flight.
+const (
+	OverlapSkip    = "skip"
+	OverlapAllow   = "allow"
+	OverlapReplace = "replace"
+)
+
+// CronSchedule tells when a recurring broadcast is due, either
+// following a cron expression or at a fixed interval.
+type CronSchedule struct {
+	minutes, hours, days, months, weekdays uint64
+	// Whether the day of the month and the day of the week are
+	// left unrestricted. When neither is, either of them matches.
+	anyDay, anyWeekday bool
+	every              time.Duration
+}
+
+var cronShortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCronSchedule reads a five fields cron expression (minute,
+// hour, day of the month, month and day of the week), one of the
+// @hourly like shortcuts, or @every followed by a duration.
+func ParseCronSchedule(spec string) (*CronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil || d < time.Second {
+			return nil, fmt.Errorf("invalid schedule %q, expected a duration of a second at least", spec)
+		}
+		return &CronSchedule{every: d}, nil
+	}
+
+	if expr, found := cronShortcuts[spec]; found {
+		spec = expr
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q, expected 5 fields", spec)
+	}
+
+	var (
+		c   CronSchedule
+		err error
+	)
+
+	if c.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if c.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if c.days, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if c.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if c.weekdays, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+
+	// Sunday is either 0 or 7.
+	if c.weekdays&(1<<7) != 0 {
+		c.weekdays |= 1
+	}
+
+	// As with Vixie cron, a field starting with a star such as
+	// */2 counts as unrestricted when the other one is not.
+	c.anyDay = strings.HasPrefix(fields[2], "*")
+	c.anyWeekday = strings.HasPrefix(fields[4], "*")
+
+	return &c, nil
+}
+
+// parseCronField reads a comma separated list of values, ranges
+// such as 1-5 and steps such as */15 or 0-30/10.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		var (
+			from, to = min, max
+			step     = 1
+			err      error
+		)
+
+		rng := part
+		if i := strings.Index(part, "/"); i != -1 {
+			rng = part[:i]
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			bounds := strings.SplitN(rng, "-", 2)
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+			if to, err = strconv.Atoi(bounds[1]); err != nil {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			if from, err = strconv.Atoi(rng); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			// A single value with a step runs up to the maximum.
+			if !strings.Contains(part, "/") {
+				to = from
+			}
+		}
+
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("%q out of the %d-%d range", part, min, max)
+		}
+
+		for v := from; v <= to; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+func (c *CronSchedule) matchesDay(t time.Time) bool {
+	var (
+		day     = c.days&(1<<uint(t.Day())) != 0
+		weekday = c.weekdays&(1<<uint(t.Weekday())) != 0
+	)
+
+	if c.anyDay || c.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// Next returns the first time the schedule is due after t.
+func (c *CronSchedule) Next(t time.Time) time.Time {
+	if c.every > 0 {
+		return t.Add(c.every)
+	}
+
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	// Any valid expression is due within a few years, give up
+	// on the ones never due such as the 31st of February.
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case c.months&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hours&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minutes&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// CronSettings describe a broadcast sent to a group at regular
+// times, read out of a [group.cron.name] section.
+type CronSettings struct {
+	Name     string        `json:"name"`
+	Schedule string        `json:"schedule"`
+	Method   string        `json:"method"`
+	Intent   string        `json:"intent,omitempty"`
+	Keys     string        `json:"keys,omitempty"`
+	Path     string        `json:"path"`
+	Host     string        `json:"host,omitempty"`
+	Priority string        `json:"priority,omitempty"`
+	Timeout  time.Duration `json:"timeout,omitempty"`
+	// Random delay, up to the given duration, added to every run
+	// so that several broadcasters don't run at once.
+	Jitter  time.Duration `json:"jitter,omitempty"`
+	Overlap string        `json:"overlap"`
+
+	Spec *CronSchedule `json:"-"`
+}
+
+// loadCronSettings reads a recurring broadcast out of a
+// [group.cron.name] section.
+func loadCronSettings(name string, s *ini.Section) (*CronSettings, error) {
+	var (
+		c = &CronSettings{
+			Name:    name,
+			Method:  "PURGE",
+			Overlap: OverlapSkip,
+		}
+		err error
+	)
+
+	if !s.HasKey("schedule") {
+		return nil, fmt.Errorf("missing schedule")
+	}
+	c.Schedule = s.Key("schedule").String()
+	if c.Spec, err = ParseCronSchedule(c.Schedule); err != nil {
+		return nil, err
+	}
+	if c.Spec.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("schedule %q is never due", c.Schedule)
+	}
+
+	c.Path = s.Key("path").String()
+	if !strings.HasPrefix(c.Path, "/") {
+		return nil, fmt.Errorf("invalid path %q, paths must start with a slash", c.Path)
+	}
+
+	if s.HasKey("method") {
+		c.Method = strings.ToUpper(s.Key("method").String())
+	}
+
+	if s.HasKey("intent") {
+		if c.Intent, err = ParseIntent(s.Key("intent").String()); err != nil {
+			return nil, err
+		}
+	}
+	c.Keys = s.Key("keys").String()
+
+	c.Host = s.Key("host").String()
+
+	if s.HasKey("priority") {
+		if c.Priority, err = ParsePriority(s.Key("priority").String()); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.HasKey("timeout") {
+		if c.Timeout, err = s.Key("timeout").Duration(); err != nil || c.Timeout < 0 {
+			return nil, fmt.Errorf("invalid timeout %q", s.Key("timeout").String())
+		}
+	}
+
+	if s.HasKey("jitter") {
+		if c.Jitter, err = s.Key("jitter").Duration(); err != nil || c.Jitter < 0 {
+			return nil, fmt.Errorf("invalid jitter %q", s.Key("jitter").String())
+		}
+	}
+
+	if s.HasKey("overlap") {
+		c.Overlap = strings.ToLower(s.Key("overlap").String())
+
+		switch c.Overlap {
+		case OverlapSkip, OverlapAllow, OverlapReplace:
+		default:
+			return nil, fmt.Errorf("invalid overlap %q, expected skip, allow or replace", c.Overlap)
+		}
+	}
+
+	return c, nil
+}
@@ -0,0 +1,95 @@
+package dao
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronSchedule(t *testing.T) {
+	tests := []struct {
+		spec  string
+		valid bool
+	}{
+		{"*/15 * * * *", true},
+		{"0 3 * * 1-5", true},
+		{"0-30/10 8-18 1,15 * 0,7", true},
+		{"@hourly", true},
+		{"@every 90s", true},
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"*/0 * * * *", false},
+		{"5-1 * * * *", false},
+		{"a * * * *", false},
+		{"@every 500ms", false},
+		{"@every soon", false},
+		{"@sometimes", false},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseCronSchedule(tt.spec)
+		if tt.valid && err != nil {
+			t.Errorf("%q: %v", tt.spec, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%q: no error", tt.spec)
+		}
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	// The 1st of January 2026 is a Thursday.
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"*/15 * * * *", at(1, 1, 0, 7), at(1, 1, 0, 15)},
+		{"*/15 * * * *", at(1, 1, 0, 15), at(1, 1, 0, 30)},
+		{"5,10 * * * *", at(1, 1, 0, 5), at(1, 1, 0, 10)},
+		{"0-30/10 * * * *", at(1, 1, 0, 31), at(1, 1, 1, 0)},
+		{"0 3 * * *", at(1, 1, 3, 0), at(1, 2, 3, 0)},
+		{"30 9 * * 1-5", at(1, 2, 10, 0), at(1, 5, 9, 30)},
+		{"0 0 1 * *", at(1, 15, 0, 0), at(2, 1, 0, 0)},
+		{"@weekly", at(1, 1, 0, 0), at(1, 4, 0, 0)},
+		{"@yearly", at(1, 1, 0, 0), time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"@every 90s", at(1, 1, 0, 0), at(1, 1, 0, 1).Add(30 * time.Second)},
+
+		// Sunday is either 0 or 7.
+		{"0 0 * * 0", at(1, 1, 0, 0), at(1, 4, 0, 0)},
+		{"0 0 * * 7", at(1, 1, 0, 0), at(1, 4, 0, 0)},
+
+		// Either the day of the month or the day of the week.
+		{"0 0 13 * 5", at(1, 1, 0, 0), at(1, 2, 0, 0)},
+		{"0 0 13 * 5", at(1, 9, 0, 0), at(1, 13, 0, 0)},
+		// Only the day of the week, the day of the month
+		// starting with a star.
+		{"0 0 */2 * 1", at(1, 1, 0, 0), at(1, 5, 0, 0)},
+		// And the other way round.
+		{"0 0 10 * */2", at(1, 1, 0, 0), at(1, 10, 0, 0)},
+		// Only the day of the month, the day of the week
+		// being left out.
+		{"0 0 */2 * *", at(1, 1, 0, 0), at(1, 3, 0, 0)},
+
+		// Never due.
+		{"0 0 31 2 *", at(1, 1, 0, 0), time.Time{}},
+	}
+
+	for _, tt := range tests {
+		c, err := ParseCronSchedule(tt.spec)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.spec, err)
+		}
+		if got := c.Next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%q after %s: got %s, want %s", tt.spec, tt.from, got, tt.want)
+		}
+	}
+}
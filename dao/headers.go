@@ -0,0 +1,52 @@
+package dao
+
+import (
+	"net/textproto"
+
+	ini "github.com/wearephenix/varnish-broadcaster/ini"
+)
+
+// HeaderPolicy decides which of the headers of the client are
+// forwarded to the caches of a group. If an allow list is given,
+// only the headers it holds are forwarded, the deny list applying
+// either way.
+type HeaderPolicy struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// Forwards reports whether the header is forwarded.
+func (p *HeaderPolicy) Forwards(name string) bool {
+	name = textproto.CanonicalMIMEHeaderKey(name)
+
+	if len(p.Allow) > 0 && !containsString(p.Allow, name) {
+		return false
+	}
+	return !containsString(p.Deny, name)
+}
+
+// Allows reports whether the header is in the allow list, and not
+// denied.
+func (p *HeaderPolicy) Allows(name string) bool {
+	name = textproto.CanonicalMIMEHeaderKey(name)
+
+	return containsString(p.Allow, name) && !containsString(p.Deny, name)
+}
+
+func canonicalHeaders(value string) []string {
+	var names = splitList(value)
+	for i := range names {
+		names[i] = textproto.CanonicalMIMEHeaderKey(names[i])
+	}
+	return names
+}
+
+// loadHeaderPolicy reads the header policy of a group out of a
+// [group.headers] section, with comma separated allow and deny
+// lists.
+func loadHeaderPolicy(s *ini.Section) (*HeaderPolicy, error) {
+	return &HeaderPolicy{
+		Allow: canonicalHeaders(s.Key("allow").String()),
+		Deny:  canonicalHeaders(s.Key("deny").String()),
+	}, nil
+}
@@ -0,0 +1,42 @@
+package dao
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	ini "github.com/wearephenix/varnish-broadcaster/ini"
+)
+
+// NormalizeHost returns the host name a Host header or the host of
+// a URL refers to, lower cased and without port.
+func NormalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// loadHostNames reads the host names served by a group out of a
+// [group.hosts] section, given as a comma separated names list.
+// A name starting with *. is a wildcard matching any of its
+// subdomains.
+func loadHostNames(s *ini.Section) ([]string, error) {
+	var names []string
+
+	for _, name := range splitList(s.Key("names").String()) {
+		if strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+			return nil, fmt.Errorf("invalid name %s, wildcards are only allowed as the first label", name)
+		}
+
+		if name = NormalizeHost(name); !containsString(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return nil, errors.New("names is required")
+	}
+	return names, nil
+}
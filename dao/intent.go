@@ -0,0 +1,124 @@
+package dao
+
+import (
+	"fmt"
+	"strings"
+
+	ini "github.com/wearephenix/varnish-broadcaster/ini"
+)
+
+// Invalidation intents a client may ask for, rather than the
+// method and headers the VCL of the caches expects.
+const (
+	IntentHard = "hard"
+	IntentSoft = "soft"
+	IntentBan  = "ban"
+	IntentXkey = "xkey"
+)
+
+// Intents lists the known invalidation intents.
+var Intents = []string{IntentHard, IntentSoft, IntentBan, IntentXkey}
+
+// KeysPlaceholder is replaced, in the header values of an intent,
+// by the keys given along with the request.
+const KeysPlaceholder = "{keys}"
+
+// Intent is the request convention of a group for an invalidation
+// intent: the method to send along with some headers.
+type Intent struct {
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// NeedsKeys reports whether the intent sends the keys given along
+// with the request.
+func (i *Intent) NeedsKeys() bool {
+	for _, v := range i.Headers {
+		if strings.Contains(v, KeysPlaceholder) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseIntent validates the name of an intent.
+func ParseIntent(value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	for _, i := range Intents {
+		if i == value {
+			return i, nil
+		}
+	}
+
+	return "", fmt.Errorf("invalid intent %q, expected hard, soft, ban or xkey", value)
+}
+
+// Intent returns the convention of the group for the intent. Unless
+// the group says otherwise, a hard purge is a PURGE while the other
+// intents are not supported.
+func (g *Group) Intent(name string) (*Intent, error) {
+	if i, found := g.Intents[name]; found {
+		return i, nil
+	}
+
+	if name == IntentHard {
+		return &Intent{Method: "PURGE"}, nil
+	}
+
+	if g.Name == "" {
+		return nil, fmt.Errorf("intent %s is only supported by groups declaring it", name)
+	}
+	return nil, fmt.Errorf("intent %s is not supported by group %s", name, g.Name)
+}
+
+// parseIntent reads the convention of an intent, the method
+// followed by comma separated headers, such as
+// "PURGE, X-Purge-Mode: soft".
+func parseIntent(value string) (*Intent, error) {
+	var (
+		parts  = strings.Split(value, ",")
+		intent = &Intent{Method: strings.ToUpper(strings.TrimSpace(parts[0]))}
+	)
+
+	if intent.Method == "" || strings.ContainsAny(intent.Method, " :") {
+		return nil, fmt.Errorf("invalid method %q", parts[0])
+	}
+
+	for _, h := range parts[1:] {
+		if h = strings.TrimSpace(h); h == "" {
+			continue
+		}
+
+		i := strings.Index(h, ":")
+		if i < 1 {
+			return nil, fmt.Errorf("invalid header %q, expected a name and a value separated by a colon", h)
+		}
+
+		if intent.Headers == nil {
+			intent.Headers = make(map[string]string)
+		}
+		intent.Headers[strings.TrimSpace(h[:i])] = strings.TrimSpace(h[i+1:])
+	}
+
+	return intent, nil
+}
+
+// loadIntents reads the conventions of a group out of a
+// [group.intents] section, keyed by intent.
+func loadIntents(s *ini.Section) (map[string]*Intent, error) {
+	var intents = make(map[string]*Intent)
+
+	for _, k := range s.Keys() {
+		name, err := ParseIntent(k.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		if intents[name], err = parseIntent(k.String()); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err.Error())
+		}
+	}
+
+	return intents, nil
+}
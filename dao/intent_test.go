@@ -0,0 +1,65 @@
+package dao
+
+import "testing"
+
+func TestLoadIntents(t *testing.T) {
+	groups, err := loadTestConfig(t, `
+[prod]
+Cache1 = http://127.0.0.1:7001
+
+[prod.intents]
+Soft = purge, X-Purge-Mode: soft
+xkey = PURGE, xkey-softpurge: {keys},
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	intents := findGroup(groups, "prod").Intents
+	if soft := intents[IntentSoft]; soft == nil || soft.Method != "PURGE" || soft.Headers["X-Purge-Mode"] != "soft" || soft.NeedsKeys() {
+		t.Errorf("soft: got %+v", soft)
+	}
+	if xkey := intents[IntentXkey]; xkey == nil || len(xkey.Headers) != 1 || xkey.Headers["xkey-softpurge"] != KeysPlaceholder || !xkey.NeedsKeys() {
+		t.Errorf("xkey: got %+v", xkey)
+	}
+}
+
+func TestLoadInvalidIntents(t *testing.T) {
+	for _, intents := range []string{
+		"refresh = PURGE",
+		"soft = ",
+		"soft = SOFT PURGE",
+		"soft = PURGE, X-Purge-Mode",
+		"soft = PURGE, : soft",
+	} {
+		if _, err := loadTestConfig(t, "[prod]\nCache1 = http://127.0.0.1:7001\n[prod.intents]\n"+intents+"\n"); err == nil {
+			t.Errorf("%q accepted", intents)
+		}
+	}
+}
+
+func TestGroupIntent(t *testing.T) {
+	g := Group{Name: "prod", Intents: map[string]*Intent{IntentBan: {Method: "BAN"}}}
+
+	if i, err := g.Intent(IntentBan); err != nil || i.Method != "BAN" {
+		t.Errorf("ban: got %+v, %v", i, err)
+	}
+
+	// A hard purge is a PURGE unless the group says otherwise.
+	if i, err := g.Intent(IntentHard); err != nil || i.Method != "PURGE" {
+		t.Errorf("hard: got %+v, %v", i, err)
+	}
+
+	if _, err := g.Intent(IntentSoft); err == nil {
+		t.Error("soft: undeclared intent supported")
+	}
+}
+
+func TestParseIntent(t *testing.T) {
+	if name, err := ParseIntent(" XKey "); err != nil || name != IntentXkey {
+		t.Errorf("got %q, %v", name, err)
+	}
+	if _, err := ParseIntent("refresh"); err == nil {
+		t.Error("unknown intent accepted")
+	}
+}
@@ -0,0 +1,193 @@
+package dao
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	ini "github.com/wearephenix/varnish-broadcaster/ini"
+)
+
+const (
+	RequireAll     = "all"
+	RequireQuorum  = "quorum"
+	RequireCount   = "count"
+	RequirePercent = "percent"
+)
+
+// StatusRange is an inclusive range of status codes.
+type StatusRange struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+// Policy decides whether a broadcast against a group succeeded,
+// and which status code the broadcaster answers with.
+type Policy struct {
+	// Status codes considered as a success when received from a cache.
+	Success []StatusRange `json:"success"`
+	// How many caches must succeed: all of them, a quorum,
+	// a number of caches or a percentage of them.
+	Require string  `json:"require"`
+	Amount  float64 `json:"amount,omitempty"`
+	// Status codes answered whether the policy is met or not.
+	MetStatus   int `json:"met_status"`
+	UnmetStatus int `json:"unmet_status"`
+}
+
+// DefaultPolicy requires every cache to answer with a 2xx.
+func DefaultPolicy() *Policy {
+	return &Policy{
+		Success:     []StatusRange{{200, 299}},
+		Require:     RequireAll,
+		MetStatus:   http.StatusOK,
+		UnmetStatus: http.StatusBadGateway,
+	}
+}
+
+// IsSuccess reports whether the status code counts as a success.
+func (p *Policy) IsSuccess(status int) bool {
+	for _, r := range p.Success {
+		if status >= r.From && status <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+// Required returns the number of caches, out of total,
+// which must succeed for the policy to be met.
+func (p *Policy) Required(total int) int {
+	switch p.Require {
+	case RequireQuorum:
+		return total/2 + 1
+	case RequireCount:
+		if n := int(p.Amount); n < total {
+			return n
+		}
+		return total
+	case RequirePercent:
+		return int(math.Ceil(float64(total) * p.Amount / 100))
+	}
+	return total
+}
+
+// IsMet reports whether enough caches, out of total, succeeded.
+func (p *Policy) IsMet(successes, total int) bool {
+	return successes >= p.Required(total)
+}
+
+// ParseStatusRanges parses a comma separated list of status codes,
+// ranges such as 200-299 or classes such as 2xx.
+func ParseStatusRanges(value string) ([]StatusRange, error) {
+	var ranges []StatusRange
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+
+		if len(item) == 3 && strings.HasSuffix(item, "xx") {
+			class, err := strconv.Atoi(item[:1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid status class %q", item)
+			}
+			ranges = append(ranges, StatusRange{class * 100, class*100 + 99})
+			continue
+		}
+
+		bounds := strings.SplitN(item, "-", 2)
+
+		from, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid status code %q", item)
+		}
+
+		to := from
+		if len(bounds) == 2 {
+			if to, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil || to < from {
+				return nil, fmt.Errorf("invalid status range %q", item)
+			}
+		}
+
+		ranges = append(ranges, StatusRange{from, to})
+	}
+
+	return ranges, nil
+}
+
+// parseRequire parses how many caches must succeed: all, quorum,
+// a number of caches such as 2 or a percentage such as 75%.
+func parseRequire(p *Policy, value string) error {
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	switch {
+	case value == RequireAll || value == RequireQuorum:
+		p.Require = value
+		return nil
+	case strings.HasSuffix(value, "%"):
+		amount, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || amount < 0 || amount > 100 {
+			return fmt.Errorf("invalid percentage %q", value)
+		}
+		p.Require, p.Amount = RequirePercent, amount
+		return nil
+	}
+
+	amount, err := strconv.Atoi(value)
+	if err != nil || amount < 0 {
+		return fmt.Errorf("invalid requirement %q, expected all, quorum, a number or a percentage", value)
+	}
+	p.Require, p.Amount = RequireCount, float64(amount)
+	return nil
+}
+
+// loadPolicy reads a policy out of a [group.policy] section,
+// any missing key keeping its default value.
+func loadPolicy(s *ini.Section) (*Policy, error) {
+	var (
+		p   = DefaultPolicy()
+		err error
+	)
+
+	if s.HasKey("success") {
+		if p.Success, err = ParseStatusRanges(s.Key("success").String()); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.HasKey("require") {
+		if err = parseRequire(p, s.Key("require").String()); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.HasKey("met-status") {
+		if p.MetStatus, err = loadStatus(s, "met-status"); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.HasKey("unmet-status") {
+		if p.UnmetStatus, err = loadStatus(s, "unmet-status"); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// loadStatus reads a status code a response can be sent with.
+func loadStatus(s *ini.Section, key string) (int, error) {
+	status, err := s.Key(key).Int()
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", key, err.Error())
+	}
+	if status < 100 || status > 599 {
+		return 0, fmt.Errorf("invalid %s %d, expected a status code between 100 and 599", key, status)
+	}
+	return status, nil
+}
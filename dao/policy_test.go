@@ -0,0 +1,32 @@
+package dao
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPolicyStatus(t *testing.T) {
+	tests := []struct {
+		settings string
+		err      string
+	}{
+		{"met-status = 207\nunmet-status = 502", ""},
+		{"met-status = 100", ""},
+		{"unmet-status = 599", ""},
+		{"met-status = 42", "invalid met-status 42"},
+		{"unmet-status = 0", "invalid unmet-status 0"},
+		{"unmet-status = 600", "invalid unmet-status 600"},
+		{"met-status = ok", "invalid met-status"},
+	}
+
+	for _, tt := range tests {
+		_, err := loadTestConfig(t, "[prod]\nCache1 = http://127.0.0.1:7001\n[prod.policy]\n"+tt.settings+"\n")
+
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%q: unexpected error %v", tt.settings, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%q: error %v, want %q", tt.settings, err, tt.err)
+		}
+	}
+}
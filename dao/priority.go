@@ -0,0 +1,71 @@
+package dao
+
+import (
+	"fmt"
+	"strings"
+
+	ini "github.com/wearephenix/varnish-broadcaster/ini"
+)
+
+// Priorities of a broadcast. Jobs of a higher priority are handled
+// ahead of the ones of a lower priority waiting in the same queue.
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// Priorities lists the priorities from the highest to the lowest.
+var Priorities = []string{PriorityHigh, PriorityNormal, PriorityLow}
+
+// ParsePriority validates the name of a priority.
+func ParsePriority(value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	for _, p := range Priorities {
+		if p == value {
+			return p, nil
+		}
+	}
+
+	return "", fmt.Errorf("invalid priority %q, expected high, normal or low", value)
+}
+
+// PrioritySettings decide the priority of the broadcasts against
+// a group which do not ask for one, either per method or for any
+// method.
+type PrioritySettings struct {
+	Default string            `json:"default,omitempty"`
+	Methods map[string]string `json:"methods,omitempty"`
+}
+
+// Of returns the priority of a broadcast of the given method, or
+// an empty string if the settings don't decide it.
+func (p *PrioritySettings) Of(method string) string {
+	if priority, found := p.Methods[strings.ToUpper(method)]; found {
+		return priority
+	}
+	return p.Default
+}
+
+// loadPrioritySettings reads the priority settings out of a
+// [group.priority] section, where the default key applies to
+// any method and any other key is the name of a method.
+func loadPrioritySettings(s *ini.Section) (*PrioritySettings, error) {
+	var p = &PrioritySettings{Methods: make(map[string]string)}
+
+	for _, k := range s.Keys() {
+		priority, err := ParsePriority(k.String())
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.ToLower(k.Name()) == "default" {
+			p.Default = priority
+		} else {
+			p.Methods[strings.ToUpper(k.Name())] = priority
+		}
+	}
+
+	return p, nil
+}
@@ -0,0 +1,79 @@
+package dao
+
+import (
+	"fmt"
+	"strings"
+
+	ini "github.com/wearephenix/varnish-broadcaster/ini"
+)
+
+// What happens to a job handed to a cache whose queue is full.
+const (
+	QueueFullBlock      = "block"
+	QueueFullReject     = "reject"
+	QueueFullDropOldest = "drop-oldest"
+)
+
+// DefaultConcurrency is the number of workers of the caches whose
+// group does not set one.
+var DefaultConcurrency = 8
+
+// QueueSettings configure the queue of jobs of each cache of a
+// group, along with the number of workers handling it. Each
+// priority gets a lane of its own, of the given size.
+type QueueSettings struct {
+	Size        int    `json:"size"`
+	Concurrency int    `json:"concurrency"`
+	Full        string `json:"full"`
+	// Number of jobs of higher priorities handled in a row while
+	// jobs of a lower priority wait, before one of them is handled.
+	StarvationLimit int `json:"starvation_limit"`
+}
+
+func DefaultQueueSettings() *QueueSettings {
+	return &QueueSettings{
+		Size:            1024,
+		Concurrency:     DefaultConcurrency,
+		Full:            QueueFullBlock,
+		StarvationLimit: 10,
+	}
+}
+
+// loadQueueSettings reads the queue settings out of a [group.queue]
+// section, any missing key keeping its default value.
+func loadQueueSettings(s *ini.Section) (*QueueSettings, error) {
+	var (
+		q   = DefaultQueueSettings()
+		err error
+	)
+
+	if s.HasKey("size") {
+		if q.Size, err = s.Key("size").Int(); err != nil || q.Size < 1 {
+			return nil, fmt.Errorf("invalid size %q", s.Key("size").String())
+		}
+	}
+
+	if s.HasKey("concurrency") {
+		if q.Concurrency, err = s.Key("concurrency").Int(); err != nil || q.Concurrency < 1 {
+			return nil, fmt.Errorf("invalid concurrency %q", s.Key("concurrency").String())
+		}
+	}
+
+	if s.HasKey("full") {
+		q.Full = strings.ToLower(s.Key("full").String())
+
+		switch q.Full {
+		case QueueFullBlock, QueueFullReject, QueueFullDropOldest:
+		default:
+			return nil, fmt.Errorf("invalid full %q, expected block, reject or drop-oldest", q.Full)
+		}
+	}
+
+	if s.HasKey("starvation-limit") {
+		if q.StarvationLimit, err = s.Key("starvation-limit").Int(); err != nil || q.StarvationLimit < 1 {
+			return nil, fmt.Errorf("invalid starvation-limit %q", s.Key("starvation-limit").String())
+		}
+	}
+
+	return q, nil
+}
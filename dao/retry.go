@@ -0,0 +1,159 @@
+package dao
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	ini "github.com/wearephenix/varnish-broadcaster/ini"
+)
+
+// Classes of errors a request against a cache may fail with.
+const (
+	ErrorTimeout    = "timeout"
+	ErrorConnection = "connection"
+	ErrorDNS        = "dns"
+	ErrorOther      = "other"
+	ErrorAll        = "all"
+)
+
+// DefaultRetries is the number of retries of the policies which
+// do not set one.
+var DefaultRetries = 1
+
+// RetryPolicy decides whether and when a failed request against
+// a cache is retried.
+type RetryPolicy struct {
+	Retries    int           `json:"retries"`
+	Backoff    time.Duration `json:"backoff"`
+	MaxBackoff time.Duration `json:"max_backoff"`
+	// Fraction of the delay which is randomized, between 0 and 1.
+	Jitter float64 `json:"jitter"`
+	// Status codes and classes of errors worth a retry.
+	Status []StatusRange `json:"status"`
+	Errors []string      `json:"errors"`
+	// Whether the Retry-After header of a response is honored.
+	RetryAfter bool `json:"retry_after"`
+}
+
+// DefaultRetryPolicy retries any error, but no status code, with
+// a short exponential backoff.
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		Retries:    DefaultRetries,
+		Backoff:    100 * time.Millisecond,
+		MaxBackoff: 5 * time.Second,
+		Jitter:     0.2,
+		Errors:     []string{ErrorAll},
+		RetryAfter: true,
+	}
+}
+
+// ShouldRetry reports whether a request which failed with the given
+// class of error, or answered with the given status code if it did
+// not fail, is worth a retry.
+func (p *RetryPolicy) ShouldRetry(status int, errClass string) bool {
+	if errClass != "" {
+		for _, c := range p.Errors {
+			if c == ErrorAll || c == errClass {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, r := range p.Status {
+		if status >= r.From && status <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay returns how long to wait before the given retry, starting
+// from 0, doubling the backoff on each retry up to its maximum.
+// rand is a random number in [0, 1) used for the jitter.
+func (p *RetryPolicy) Delay(retry int, rand float64) time.Duration {
+	d := p.Backoff
+	for i := 0; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	return time.Duration(float64(d) * (1 - p.Jitter*rand))
+}
+
+func parseErrorClasses(value string) ([]string, error) {
+	var classes []string
+
+	for _, c := range strings.Split(value, ",") {
+		c = strings.ToLower(strings.TrimSpace(c))
+
+		switch c {
+		case "":
+			continue
+		case ErrorTimeout, ErrorConnection, ErrorDNS, ErrorOther, ErrorAll:
+			classes = append(classes, c)
+		default:
+			return nil, fmt.Errorf("invalid error class %q", c)
+		}
+	}
+
+	return classes, nil
+}
+
+// loadRetryPolicy reads a retry policy out of a [group.retry]
+// section, any missing key keeping its default value.
+func loadRetryPolicy(s *ini.Section) (*RetryPolicy, error) {
+	var (
+		p   = DefaultRetryPolicy()
+		err error
+	)
+
+	if s.HasKey("retries") {
+		if p.Retries, err = s.Key("retries").Int(); err != nil || p.Retries < 0 {
+			return nil, fmt.Errorf("invalid retries %q", s.Key("retries").String())
+		}
+	}
+
+	if s.HasKey("backoff") {
+		if p.Backoff, err = s.Key("backoff").Duration(); err != nil {
+			return nil, fmt.Errorf("invalid backoff: %s", err.Error())
+		}
+	}
+
+	if s.HasKey("max-backoff") {
+		if p.MaxBackoff, err = s.Key("max-backoff").Duration(); err != nil {
+			return nil, fmt.Errorf("invalid max-backoff: %s", err.Error())
+		}
+	}
+
+	if s.HasKey("jitter") {
+		if p.Jitter, err = s.Key("jitter").Float64(); err != nil || p.Jitter < 0 || p.Jitter > 1 {
+			return nil, fmt.Errorf("invalid jitter %q, expected a number between 0 and 1", s.Key("jitter").String())
+		}
+	}
+
+	if s.HasKey("status") {
+		if p.Status, err = ParseStatusRanges(s.Key("status").String()); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.HasKey("errors") {
+		if p.Errors, err = parseErrorClasses(s.Key("errors").String()); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.HasKey("retry-after") {
+		if p.RetryAfter, err = s.Key("retry-after").Bool(); err != nil {
+			return nil, fmt.Errorf("invalid retry-after: %s", err.Error())
+		}
+	}
+
+	return p, nil
+}
@@ -0,0 +1,75 @@
+package dao
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	p := &RetryPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second, Jitter: 0.5}
+
+	tests := []struct {
+		retry int
+		rand  float64
+		want  time.Duration
+	}{
+		{0, 0, 100 * time.Millisecond},
+		{1, 0, 200 * time.Millisecond},
+		{3, 0, 800 * time.Millisecond},
+		{4, 0, time.Second},
+		{40, 0, time.Second},
+		{0, 0.5, 75 * time.Millisecond},
+		{4, 0.5, 750 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		if got := p.Delay(tt.retry, tt.rand); got != tt.want {
+			t.Errorf("Delay(%d, %v) = %s, want %s", tt.retry, tt.rand, got, tt.want)
+		}
+	}
+}
+
+func TestRetryDelayJitterBounds(t *testing.T) {
+	p := &RetryPolicy{Backoff: time.Second, MaxBackoff: time.Second, Jitter: 0.2}
+
+	for _, rand := range []float64{0, 0.25, 0.5, 0.75, 0.9999} {
+		if d := p.Delay(0, rand); d > time.Second || d <= 800*time.Millisecond {
+			t.Errorf("Delay(0, %v) = %s, want within (800ms, 1s]", rand, d)
+		}
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	p := &RetryPolicy{
+		Status: []StatusRange{{From: 500, To: 504}, {From: 429, To: 429}},
+		Errors: []string{ErrorTimeout, ErrorConnection},
+	}
+
+	tests := []struct {
+		status   int
+		errClass string
+		want     bool
+	}{
+		{503, "", true},
+		{429, "", true},
+		{505, "", false},
+		{404, "", false},
+		{200, "", false},
+		{0, ErrorTimeout, true},
+		{0, ErrorConnection, true},
+		{0, ErrorDNS, false},
+		// The status of a failed request is meaningless.
+		{503, ErrorDNS, false},
+	}
+
+	for _, tt := range tests {
+		if got := p.ShouldRetry(tt.status, tt.errClass); got != tt.want {
+			t.Errorf("ShouldRetry(%d, %q) = %v, want %v", tt.status, tt.errClass, got, tt.want)
+		}
+	}
+
+	all := &RetryPolicy{Errors: []string{ErrorAll}}
+	if !all.ShouldRetry(0, ErrorOther) {
+		t.Error("all does not retry other errors")
+	}
+}
@@ -0,0 +1,194 @@
+package dao
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	ini "github.com/wearephenix/varnish-broadcaster/ini"
+)
+
+// PathRewrite replaces the paths matching a regular expression.
+type PathRewrite struct {
+	Pattern     *regexp.Regexp `json:"-"`
+	Expression  string         `json:"pattern"`
+	Replacement string         `json:"replacement"`
+}
+
+// RewriteRules alter the request sent to each cache of a group,
+// such as staging caches expecting another host and a path prefix.
+type RewriteRules struct {
+	Methods       map[string]string `json:"methods,omitempty"`
+	StripPrefix   string            `json:"strip_prefix,omitempty"`
+	Paths         []PathRewrite     `json:"paths,omitempty"`
+	AddPrefix     string            `json:"add_prefix,omitempty"`
+	Host          string            `json:"host,omitempty"`
+	SetHeaders    map[string]string `json:"set_headers,omitempty"`
+	RemoveHeaders []string          `json:"remove_headers,omitempty"`
+	// Query parameters kept, all of them if empty, and dropped.
+	QueryKeep []string `json:"query_keep,omitempty"`
+	QueryDrop []string `json:"query_drop,omitempty"`
+}
+
+// Apply rewrites the request of the cache, whose headers must be
+// its own. The method is mapped first, then the path has its
+// prefix stripped, goes through the regular expressions and gets
+// its prefix added.
+func (rw *RewriteRules) Apply(c *Cache) {
+	if method, found := rw.Methods[c.Method]; found {
+		c.Method = method
+	}
+
+	c.Item = rw.stripPrefix(c.Item)
+
+	for _, p := range rw.Paths {
+		c.Item = p.Pattern.ReplaceAllString(c.Item, p.Replacement)
+	}
+
+	if rw.AddPrefix != "" {
+		c.Item = strings.TrimSuffix(rw.AddPrefix, "/") + c.Item
+	}
+
+	if rw.Host != "" {
+		c.Host = rw.Host
+	}
+
+	for _, h := range rw.RemoveHeaders {
+		c.Headers.Del(h)
+	}
+	for k, v := range rw.SetHeaders {
+		c.Headers.Set(k, v)
+	}
+
+	if len(rw.QueryKeep) > 0 || len(rw.QueryDrop) > 0 {
+		c.Parameters = rw.filterQuery(c.Parameters)
+	}
+}
+
+// stripPrefix removes the prefix from the path, provided it ends
+// on a segment boundary: /www strips /www and /www/a, not /wwwx.
+func (rw *RewriteRules) stripPrefix(path string) string {
+	prefix := strings.TrimSuffix(rw.StripPrefix, "/")
+	if prefix == "" {
+		return path
+	}
+
+	if path == prefix || strings.HasPrefix(path, prefix+"/") {
+		if path = strings.TrimPrefix(path, prefix); path == "" {
+			path = "/"
+		}
+	}
+	return path
+}
+
+// filterQuery drops the query parameters not kept, keeping the
+// order of the others.
+func (rw *RewriteRules) filterQuery(query string) string {
+	var kept []string
+
+	for _, param := range strings.Split(query, "&") {
+		if param == "" {
+			continue
+		}
+
+		name := param
+		if i := strings.Index(param, "="); i != -1 {
+			name = param[:i]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+
+		if len(rw.QueryKeep) > 0 && !containsString(rw.QueryKeep, name) {
+			continue
+		}
+		if containsString(rw.QueryDrop, name) {
+			continue
+		}
+
+		kept = append(kept, param)
+	}
+
+	return strings.Join(kept, "&")
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(value string) []string {
+	var out []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// loadRewriteRules reads the rewrite rules of a group out of a
+// [group.rewrite] section. Methods are mapped with method.NAME
+// keys, headers set with header.NAME keys, and paths rewritten
+// with path keys, or keys starting with path., holding a regular
+// expression and its replacement separated by =>.
+func loadRewriteRules(s *ini.Section) (*RewriteRules, error) {
+	var rw = &RewriteRules{
+		Methods:    make(map[string]string),
+		SetHeaders: make(map[string]string),
+	}
+
+	for _, k := range s.Keys() {
+		var (
+			name  = k.Name()
+			value = k.String()
+		)
+
+		switch {
+		case name == "strip-prefix":
+			rw.StripPrefix = value
+		case name == "add-prefix":
+			rw.AddPrefix = value
+		case name == "host":
+			rw.Host = value
+		case name == "remove-headers":
+			rw.RemoveHeaders = splitList(value)
+		case name == "query-keep":
+			rw.QueryKeep = splitList(value)
+		case name == "query-drop":
+			rw.QueryDrop = splitList(value)
+		case strings.HasPrefix(name, "method."):
+			rw.Methods[strings.ToUpper(strings.TrimPrefix(name, "method."))] = strings.ToUpper(value)
+		case strings.HasPrefix(name, "header."):
+			rw.SetHeaders[strings.TrimPrefix(name, "header.")] = value
+		case name == "path" || strings.HasPrefix(name, "path."):
+			parts := strings.SplitN(value, "=>", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid %s %q, expected a regular expression and its replacement separated by =>", name, value)
+			}
+
+			p := PathRewrite{Expression: strings.TrimSpace(parts[0]), Replacement: strings.TrimSpace(parts[1])}
+			pattern, err := regexp.Compile(p.Expression)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", name, err.Error())
+			}
+			p.Pattern = pattern
+			rw.Paths = append(rw.Paths, p)
+		default:
+			return nil, fmt.Errorf("unknown key %s", name)
+		}
+	}
+
+	for _, prefix := range []string{rw.StripPrefix, rw.AddPrefix} {
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("invalid prefix %q, prefixes must start with a slash", prefix)
+		}
+	}
+
+	return rw, nil
+}
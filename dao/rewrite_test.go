@@ -0,0 +1,105 @@
+package dao
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+func TestRewriteStripPrefix(t *testing.T) {
+	tests := []struct {
+		prefix, path, want string
+	}{
+		{"/www", "/www/news", "/news"},
+		{"/www", "/www", "/"},
+		{"/www", "/www/", "/"},
+		{"/www", "/wwwnews", "/wwwnews"},
+		{"/www", "/news", "/news"},
+		{"/www/", "/www/news", "/news"},
+		{"/www/", "/www", "/"},
+		{"/www/", "/wwwnews", "/wwwnews"},
+		{"/a/b", "/a/b/c", "/c"},
+		{"/a/b", "/a/bc", "/a/bc"},
+		{"/", "/news", "/news"},
+	}
+
+	for _, tt := range tests {
+		rw := &RewriteRules{StripPrefix: tt.prefix}
+		c := Cache{Item: tt.path, Headers: make(http.Header)}
+		rw.Apply(&c)
+
+		if c.Item != tt.want {
+			t.Errorf("strip %q from %q: got %q, want %q", tt.prefix, tt.path, c.Item, tt.want)
+		}
+	}
+}
+
+func TestRewriteApply(t *testing.T) {
+	rw := &RewriteRules{
+		Methods:     map[string]string{"PURGE": "BAN"},
+		StripPrefix: "/www",
+		Paths: []PathRewrite{
+			{Pattern: regexp.MustCompile(`^/old/(.*)$`), Replacement: "/new/$1"},
+		},
+		AddPrefix:     "/staging/",
+		Host:          "staging.example.com",
+		SetHeaders:    map[string]string{"X-Env": "staging"},
+		RemoveHeaders: []string{"Cookie"},
+		QueryDrop:     []string{"utm_source"},
+	}
+
+	c := Cache{
+		Method:     "PURGE",
+		Item:       "/www/old/page",
+		Parameters: "utm_source=mail&id=42",
+		Host:       "www.example.com",
+		Headers:    http.Header{"Cookie": {"session=1"}, "X-Keep": {"1"}},
+	}
+	rw.Apply(&c)
+
+	if c.Method != "BAN" {
+		t.Errorf("method: got %s, want BAN", c.Method)
+	}
+	if c.Item != "/staging/new/page" {
+		t.Errorf("path: got %s, want /staging/new/page", c.Item)
+	}
+	if c.Parameters != "id=42" {
+		t.Errorf("query: got %s, want id=42", c.Parameters)
+	}
+	if c.Host != "staging.example.com" {
+		t.Errorf("host: got %s, want staging.example.com", c.Host)
+	}
+	if c.Headers.Get("Cookie") != "" || c.Headers.Get("X-Keep") != "1" || c.Headers.Get("X-Env") != "staging" {
+		t.Errorf("headers: got %v", c.Headers)
+	}
+
+	// Methods without a mapping are kept.
+	c = Cache{Method: "GET", Item: "/", Headers: make(http.Header)}
+	rw.Apply(&c)
+	if c.Method != "GET" {
+		t.Errorf("unmapped method: got %s, want GET", c.Method)
+	}
+}
+
+func TestRewriteFilterQuery(t *testing.T) {
+	tests := []struct {
+		keep, drop []string
+		query      string
+		want       string
+	}{
+		{nil, []string{"utm_source"}, "utm_source=a&id=1&utm_source=b", "id=1"},
+		{[]string{"id", "page"}, nil, "page=2&utm_source=a&id=1", "page=2&id=1"},
+		{[]string{"id"}, []string{"id"}, "id=1", ""},
+		{nil, []string{"flag"}, "flag&id=1", "id=1"},
+		{nil, []string{"a b"}, "a+b=1&a%20b=2&id=1", "id=1"},
+		{nil, []string{"x"}, "&&id=1&", "id=1"},
+		{[]string{"id"}, nil, "", ""},
+	}
+
+	for _, tt := range tests {
+		rw := &RewriteRules{QueryKeep: tt.keep, QueryDrop: tt.drop}
+		if got := rw.filterQuery(tt.query); got != tt.want {
+			t.Errorf("keep %v, drop %v, %q: got %q, want %q", tt.keep, tt.drop, tt.query, got, tt.want)
+		}
+	}
+}
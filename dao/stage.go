@@ -0,0 +1,92 @@
+package dao
+
+import (
+	"fmt"
+	"strings"
+
+	ini "github.com/wearephenix/varnish-broadcaster/ini"
+)
+
+// Stage is a set of caches of a group broadcasted to together.
+// The stages of a group are broadcasted to one after the other,
+// a stage only once the previous one met the policy of the group,
+// e.g. shields before the edges fetching from them.
+type Stage struct {
+	Name   string   `json:"name"`
+	Caches []string `json:"caches"`
+}
+
+// loadStages reads the stages of a group out of a [group.stages]
+// section, in order, where each key is the name of a stage and its
+// value the comma separated names of its caches. Every cache of
+// the group must belong to a single stage.
+func loadStages(g *Group, s *ini.Section) ([]Stage, error) {
+	var (
+		stages []Stage
+		staged = make(map[string]string)
+	)
+
+	for _, c := range g.Caches {
+		staged[c.Name] = ""
+	}
+
+	for _, k := range s.Keys() {
+		var stage = Stage{Name: k.Name()}
+
+		for _, name := range strings.Split(k.String(), ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+
+			other, found := staged[name]
+			if !found {
+				return nil, fmt.Errorf("unknown cache %s in stage %s", name, stage.Name)
+			}
+			if other != "" {
+				return nil, fmt.Errorf("cache %s is in both stages %s and %s", name, other, stage.Name)
+			}
+
+			staged[name] = stage.Name
+			stage.Caches = append(stage.Caches, name)
+		}
+
+		if len(stage.Caches) == 0 {
+			return nil, fmt.Errorf("stage %s has no caches", stage.Name)
+		}
+		stages = append(stages, stage)
+	}
+
+	for _, c := range g.Caches {
+		if staged[c.Name] == "" {
+			return nil, fmt.Errorf("cache %s is in no stage", c.Name)
+		}
+	}
+
+	return stages, nil
+}
+
+// StageCaches returns the indexes, among the caches of the group,
+// of the caches of each stage. A group without stages has a single
+// one holding all of its caches.
+func (g *Group) StageCaches() [][]int {
+	var indexes = make(map[string]int, len(g.Caches))
+	for i, c := range g.Caches {
+		indexes[c.Name] = i
+	}
+
+	if len(g.Stages) == 0 {
+		var all = make([]int, len(g.Caches))
+		for i := range all {
+			all[i] = i
+		}
+		return [][]int{all}
+	}
+
+	var out = make([][]int, len(g.Stages))
+	for i, stage := range g.Stages {
+		for _, name := range stage.Caches {
+			out[i] = append(out[i], indexes[name])
+		}
+	}
+	return out
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+// broadcastTimeout returns the deadline requested through the
+// X-Timeout header, either a duration such as 1500ms or a number
+// of seconds. No deadline is set if the header is missing.
+func broadcastTimeout(r *http.Request) (time.Duration, error) {
+	value := r.Header.Get("X-Timeout")
+	if value == "" {
+		return 0, nil
+	}
+
+	if d, ok := parseDuration(value); ok {
+		return d, nil
+	}
+
+	return 0, fmt.Errorf("Invalid X-Timeout %q, expected a duration such as 1500ms or a number of seconds.", value)
+}
+
+// parseDuration reads a positive duration given either as such,
+// e.g. 1500ms, or as a number of seconds.
+func parseDuration(value string) (time.Duration, bool) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second)), true
+	}
+
+	if d, err := time.ParseDuration(value); err == nil && d > 0 {
+		return d, true
+	}
+
+	return 0, false
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// unfinishedResult is the outcome reported for a cache which did
+// not answer before the context of the broadcast was done.
+func unfinishedResult(ctx context.Context, cache dao.Cache) cacheResult {
+	cr := cacheResult{Name: cache.Name, Address: cache.Address, Status: http.StatusGatewayTimeout, Error: "timed out"}
+
+	if errors.Is(ctx.Err(), context.Canceled) {
+		cr.Error = "canceled"
+	}
+
+	return cr
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+func TestBroadcastTimeout(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		invalid bool
+	}{
+		{"", 0, false},
+		{"1500ms", 1500 * time.Millisecond, false},
+		{"2", 2 * time.Second, false},
+		{"0.5", 500 * time.Millisecond, false},
+		{"0", 0, true},
+		{"-1s", 0, true},
+		{"soon", 0, true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("PURGE", "/", nil)
+		r.Header.Set("X-Timeout", tt.value)
+
+		got, err := broadcastTimeout(r)
+		if (err != nil) != tt.invalid || got != tt.want {
+			t.Errorf("X-Timeout %q: got %v, %v", tt.value, got, err)
+		}
+	}
+}
+
+// slowCache starts a cache which answers once released, and reports
+// on canceled whether its request was canceled before that.
+func slowCache(t *testing.T) (cache dao.Cache, canceled <-chan struct{}) {
+	release := make(chan struct{})
+	done := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+
+	cache = testCache(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(done)
+		case <-release:
+		}
+	})
+	return cache, done
+}
+
+func TestTimeoutReturnsPartialResults(t *testing.T) {
+	fast := testCache(t, func(w http.ResponseWriter, r *http.Request) {})
+	slow, canceled := slowCache(t)
+	useGroups(t, dao.Group{Name: "prod", Caches: []dao.Cache{fast, slow}})
+
+	r := httptest.NewRequest("PURGE", "/page", nil)
+	r.Header.Set("X-Group", "prod")
+	r.Header.Set("X-Timeout", "100ms")
+	w := httptest.NewRecorder()
+
+	start := time.Now()
+	reqHandler(w, r)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("the broadcast took %s despite its deadline", elapsed)
+	}
+
+	var codes map[string]int
+	if err := json.Unmarshal(w.Body.Bytes(), &codes); err != nil {
+		t.Fatal(err)
+	}
+	if codes[fast.Name] != http.StatusOK || codes[slow.Name] != http.StatusGatewayTimeout {
+		t.Errorf("got the codes %v", codes)
+	}
+
+	// The deadline reaches the request sent to the slow cache.
+	select {
+	case <-canceled:
+	case <-time.After(2 * time.Second):
+		t.Error("the request to the slow cache was not canceled")
+	}
+}
+
+func TestUnfinishedCachesOfBroadcast(t *testing.T) {
+	fast := testCache(t, func(w http.ResponseWriter, r *http.Request) {})
+	slow, _ := slowCache(t)
+
+	ctx, cancel := withTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	res := broadcast(ctx, broadcastRequest{Method: "PURGE", Path: "/page"}, testGroup(fast, slow), nil)
+
+	if cr := res.Caches[0]; cr.Status != http.StatusOK || cr.Error != "" {
+		t.Errorf("%s: got %+v", fast.Name, cr)
+	}
+	if cr := res.Caches[1]; cr.Status != http.StatusGatewayTimeout || cr.Error != "timed out" {
+		t.Errorf("%s: got %+v, want it unfinished", slow.Name, cr)
+	}
+
+	// The caches of a canceled broadcast are left unanswered too.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+
+	res = broadcast(ctx, broadcastRequest{Method: "PURGE", Path: "/page"}, testGroup(slow), nil)
+	if cr := res.Caches[0]; cr.Status != http.StatusGatewayTimeout || cr.Error == "" {
+		t.Errorf("%s: got %+v, want it unfinished", slow.Name, cr)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+// plannedRequest is a request a broadcast would send to a cache,
+// as reported by a dry run.
+type plannedRequest struct {
+	// Group of the cache, given when the broadcast is routed to
+	// several groups.
+	Group    string      `json:"group,omitempty"`
+	Cache    string      `json:"cache"`
+	Address  string      `json:"address"`
+	Stage    string      `json:"stage,omitempty"`
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Host     string      `json:"host"`
+	Headers  http.Header `json:"headers"`
+	BodySize int64       `json:"body_size,omitempty"`
+	Priority string      `json:"priority"`
+	Circuit  string      `json:"circuit,omitempty"`
+}
+
+// dryRunResult is the answer to a dry run, the requests being in
+// the order they would be sent in.
+type dryRunResult struct {
+	Group    string           `json:"group,omitempty"`
+	Policy   *dao.Policy      `json:"policy,omitempty"`
+	Guard    string           `json:"guard,omitempty"`
+	Requests []plannedRequest `json:"requests"`
+}
+
+// plannedItem holds the requests an item of a bulk request would
+// send to each cache of the group it is routed to.
+type plannedItem struct {
+	Item     int              `json:"item"`
+	Group    string           `json:"group,omitempty"`
+	Method   string           `json:"method"`
+	Path     string           `json:"path"`
+	Host     string           `json:"host,omitempty"`
+	Requests []plannedRequest `json:"requests"`
+}
+
+// bulkDryRunResult is the answer to a dry run of a bulk request,
+// the items being in the order they were given in.
+type bulkDryRunResult struct {
+	Guard string        `json:"guard,omitempty"`
+	Items []plannedItem `json:"items"`
+}
+
+func isDryRun(r *http.Request) bool {
+	return strings.ToLower(r.Header.Get("X-Dry-Run")) == "true"
+}
+
+// planBroadcast returns the requests broadcasting br to the group
+// would send, stage after stage and host after host. The state of
+// the circuit of each cache is given for the groups with a circuit
+// breaker, no request being sent while it is open.
+func planBroadcast(br broadcastRequest, group dao.Group) []plannedRequest {
+	var (
+		planned []plannedRequest
+		hosts   = br.Hosts
+	)
+
+	if len(hosts) == 0 {
+		hosts = []string{br.Host}
+	}
+
+	for stage, indexes := range group.StageCaches() {
+		for _, host := range hosts {
+			hbr := br
+			hbr.Host, hbr.Hosts = host, nil
+
+			for _, idx := range indexes {
+				cache := cacheRequest(hbr, group.Caches[idx])
+
+				pr := plannedRequest{
+					Cache:    cache.Name,
+					Address:  cache.Address,
+					Method:   cache.Method,
+					URL:      cache.Address + cache.Item,
+					Host:     cache.Host,
+					Headers:  outgoingHeaders(cache, br.Body),
+					Priority: dao.Priorities[priorityLane(br.Priority)],
+				}
+
+				if cache.Parameters != "" {
+					pr.URL += "?" + cache.Parameters
+				}
+				if len(group.Stages) > 0 {
+					pr.Stage = group.Stages[stage].Name
+				}
+				if br.Body != nil {
+					pr.BodySize = br.Body.size
+				}
+				if b := cacheBreaker(cache); b != nil {
+					pr.Circuit = b.status().State
+				}
+
+				planned = append(planned, pr)
+			}
+		}
+	}
+
+	return planned
+}
+
+// writeDryRun answers with the requests the broadcast of r would
+// send to each cache of the groups it is routed to, without sending
+// any.
+func writeDryRun(w http.ResponseWriter, r *http.Request, routes []groupRoute, body *requestBody) {
+	reqs, err := routeRequests(r, routes, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sendToLogChannel("Dry run of ", reqs[0].Method, " ", reqs[0].Path, ".\n")
+
+	res := dryRunResult{Group: routesName(routes)}
+	if len(routes) == 1 {
+		res.Policy = routes[0].group.Policy
+	}
+
+	for i, route := range routes {
+		planned := planBroadcast(reqs[i], route.group)
+		if len(routes) > 1 {
+			for j := range planned {
+				planned[j].Group = route.name
+			}
+		}
+		res.Requests = append(res.Requests, planned...)
+	}
+
+	// Tell whether the broadcast would be let through.
+	if err := guardRequest(r, routes, body); err != nil {
+		res.Guard = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	out, _ := json.MarshalIndent(res, "", "  ")
+	w.Write(out)
+}
+
+// writeBulkDryRun answers with the requests each item of a bulk
+// request would send to the caches of its group, without sending
+// any.
+func writeBulkDryRun(w http.ResponseWriter, r *http.Request, rs *bulkRoutes) {
+	var res = bulkDryRunResult{Items: make([]plannedItem, rs.total)}
+
+	for _, route := range rs.routes {
+		for i, br := range route.reqs {
+			res.Items[route.indexes[i]] = plannedItem{
+				Item:     route.indexes[i],
+				Group:    route.name,
+				Method:   br.Method,
+				Path:     br.Path,
+				Host:     br.Host,
+				Requests: planBroadcast(br, route.group),
+			}
+		}
+	}
+
+	// Tell whether the items would be let through.
+	if err := guardBulk(r, rs); err != nil {
+		res.Guard = err.Error()
+	}
+
+	sendToLogChannel("Dry run of ", fmt.Sprint(rs.total), " items.\n")
+
+	w.Header().Set("Content-Type", "application/json")
+	out, _ := json.MarshalIndent(res, "", "  ")
+	w.Write(out)
+}
+
+// dryRunHandler serves /dry-run/, which answers with the requests
+// a broadcast of the rest of the path would send to each cache, as
+// if sent to the broadcast port with an X-Dry-Run header.
+func dryRunHandler(w http.ResponseWriter, r *http.Request) {
+	dr := r.Clone(r.Context())
+	dr.URL.Path = strings.TrimPrefix(r.URL.Path, "/dry-run")
+	dr.URL.RawPath = ""
+	dr.Header.Set("X-Dry-Run", "true")
+
+	reqHandler(w, dr)
+}
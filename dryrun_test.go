@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+func TestBulkDryRun(t *testing.T) {
+	var hits int32
+	cache := testCache(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	})
+
+	useGroups(t,
+		dao.Group{Name: "prod", Hosts: []string{"www.example.com"}, Caches: []dao.Cache{cache}},
+		dao.Group{Name: "eu", Hosts: []string{"www.example.eu"}, Caches: []dao.Cache{cache, cache}},
+	)
+
+	tests := []struct {
+		handler http.HandlerFunc
+		body    string
+	}{
+		{bulkHandler, "/a\n{\"path\": \"/b\", \"host\": \"www.example.eu\"}\n"},
+		{urlsHandler, "https://www.example.com/a\nhttps://www.example.eu/b\n"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+		r.Host = "www.example.com"
+		r.Header.Set("X-Dry-Run", "true")
+		w := httptest.NewRecorder()
+		tt.handler(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("got a %d: %s", w.Code, w.Body)
+		}
+
+		var res bulkDryRunResult
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Items) != 2 {
+			t.Fatalf("got %d items, want 2", len(res.Items))
+		}
+
+		for i, want := range []struct {
+			group, path string
+			requests    int
+		}{{"prod", "/a", 1}, {"eu", "/b", 2}} {
+			item := res.Items[i]
+			if item.Item != i || item.Group != want.group || item.Path != want.path || len(item.Requests) != want.requests {
+				t.Errorf("item %d: got %s %s with %d requests, want %s %s with %d", i, item.Group, item.Path, len(item.Requests), want.group, want.path, want.requests)
+			}
+		}
+	}
+
+	if n := atomic.LoadInt32(&hits); n != 0 {
+		t.Errorf("the dry runs sent %d requests", n)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+// guardError rejects a destructive broadcast which was not
+// confirmed.
+type guardError struct {
+	reason string
+}
+
+func (e *guardError) Error() string {
+	return e.reason + " Send X-Confirm: true, or an X-Guard-Token, to go ahead."
+}
+
+// wideBanPatterns are the ban patterns matching every object, once
+// their anchors and leading slash removed.
+var wideBanPatterns = map[string]bool{
+	"":    true,
+	".":   true,
+	".*":  true,
+	".+":  true,
+	".*?": true,
+}
+
+// matchesEverything reports whether a ban pattern, or the right
+// hand side of a ban expression such as req.url ~ .*, matches
+// every object.
+func matchesEverything(pattern string) bool {
+	if i := strings.LastIndex(pattern, "~"); i != -1 {
+		pattern = pattern[i+1:]
+	}
+
+	pattern = strings.Trim(strings.TrimSpace(pattern), `"`)
+	pattern = strings.TrimSuffix(strings.TrimPrefix(pattern, "^"), "$")
+	return wideBanPatterns[strings.TrimPrefix(pattern, "/")]
+}
+
+// confirmed reports whether the request goes ahead despite the
+// guardrails, either through an X-Confirm header or the token given
+// with -guard-token.
+func confirmed(r *http.Request) bool {
+	if strings.ToLower(r.Header.Get("X-Confirm")) == "true" {
+		return true
+	}
+
+	token := r.Header.Get("X-Guard-Token")
+	return *guardToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(*guardToken)) == 1
+}
+
+// everyCache reports whether the group is made of every configured
+// cache, as when no group is given.
+func everyCache(groupName string, group dao.Group) bool {
+	locker.Lock()
+	defer locker.Unlock()
+
+	return groupName == "" && len(group.Caches) == len(allCaches)
+}
+
+// destructiveRequest returns why the request sent to the cache
+// would wipe it out, if it would: purging the root of the site or
+// banning with a pattern matching everything, be it in the path
+// asked for by the client or once rewritten, a header or a line of
+// the body. Only the headers with "ban" in their name are looked
+// at, the patterns given in other headers are let through.
+func destructiveRequest(path string, cache dao.Cache, body *requestBody) string {
+	var paths = []string{path, cache.Item}
+
+	for _, p := range paths {
+		if p == "" || p == "/" {
+			return fmt.Sprintf("%s of / wipes %s out.", cache.Method, cache.Name)
+		}
+	}
+
+	if !strings.EqualFold(cache.Method, "BAN") {
+		return ""
+	}
+
+	for _, p := range paths {
+		if matchesEverything(strings.TrimPrefix(p, "/")) {
+			return fmt.Sprintf("BAN of %s wipes %s out.", p, cache.Name)
+		}
+	}
+
+	for name, values := range cache.Headers {
+		if !strings.Contains(strings.ToLower(name), "ban") {
+			continue
+		}
+		for _, v := range values {
+			if matchesEverything(v) {
+				return fmt.Sprintf("BAN with %s: %s wipes %s out.", name, v, cache.Name)
+			}
+		}
+	}
+
+	if body == nil {
+		return ""
+	}
+
+	data, err := body.bytes()
+	if err != nil {
+		return fmt.Sprintf("BAN with a body which can't be read: %s.", err.Error())
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) != "" && matchesEverything(line) {
+			return fmt.Sprintf("BAN with %s in the body wipes %s out.", strings.TrimSpace(line), cache.Name)
+		}
+	}
+
+	return ""
+}
+
+// guardCaches returns why broadcasting to that many caches is too
+// destructive to go ahead unconfirmed, if it is more than
+// -guard-max-caches and the guardrails are on.
+func guardCaches(r *http.Request, count int) error {
+	if !*guardrails || confirmed(r) {
+		return nil
+	}
+
+	if *guardMaxCaches > 0 && count > *guardMaxCaches {
+		return &guardError{fmt.Sprintf("The broadcast targets %d caches, more than %d.", count, *guardMaxCaches)}
+	}
+
+	return nil
+}
+
+// guardBroadcast returns why broadcasting the requests to the group
+// is too destructive to go ahead unconfirmed, if it is and the
+// guardrails are on: targeting every cache or wiping a cache out.
+// The number of caches is checked once for the whole broadcast,
+// with guardCaches.
+func guardBroadcast(r *http.Request, groupName string, group dao.Group, reqs []broadcastRequest) error {
+	if !*guardrails || confirmed(r) {
+		return nil
+	}
+
+	if everyCache(groupName, group) {
+		return &guardError{"The broadcast targets every cache, X-Group is not given."}
+	}
+
+	for _, br := range reqs {
+		for _, cache := range group.Caches {
+			if reason := destructiveRequest(br.Path, cacheRequest(br, cache), br.Body); reason != "" {
+				return &guardError{reason}
+			}
+		}
+	}
+
+	return nil
+}
+
+// guardRequest applies the guardrails to the broadcast of the
+// request to each group it is routed to. Requests the broadcast of
+// which can't be prepared are let through, to be rejected along
+// the way.
+func guardRequest(r *http.Request, routes []groupRoute, body *requestBody) error {
+	if err := guardCaches(r, routesCaches(routes)); err != nil {
+		return err
+	}
+
+	reqs, err := routeRequests(r, routes, body)
+	if err != nil {
+		return nil
+	}
+
+	for i, route := range routes {
+		if err := guardBroadcast(r, route.name, route.group, reqs[i:i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// guardBulk applies the guardrails to the items of a bulk or url
+// request, as a whole.
+func guardBulk(r *http.Request, rs *bulkRoutes) error {
+	if err := guardCaches(r, rs.caches()); err != nil {
+		return err
+	}
+
+	for _, route := range rs.routes {
+		if err := guardBroadcast(r, route.name, route.group, route.reqs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+func TestMatchesEverything(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    bool
+	}{
+		{"", true},
+		{".*", true},
+		{"^/.*$", true},
+		{"/.+", true},
+		{"^.*?$", true},
+		{`req.url ~ "."`, true},
+		{"req.url ~ .*", true},
+		{`obj.http.x-url ~ "^/.*$"`, true},
+		{"^/products/.*$", false},
+		{`req.url ~ "^/news"`, false},
+		{"/page", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchesEverything(tt.pattern); got != tt.want {
+			t.Errorf("matchesEverything(%q) = %v, want %v", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestDestructiveRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		header  http.Header
+		body    string
+		rewrite *dao.RewriteRules
+		want    bool
+	}{
+		{"purge of a page", "PURGE", "/page", nil, "", nil, false},
+		{"purge of the root", "PURGE", "/", nil, "", nil, true},
+		{"purge rewritten to the root", "PURGE", "/home", nil, "", &dao.RewriteRules{
+			Paths: []dao.PathRewrite{{Pattern: regexp.MustCompile("^/home$"), Replacement: "/"}},
+		}, true},
+		{"purge with a stripped prefix", "PURGE", "/www", nil, "", &dao.RewriteRules{StripPrefix: "/www"}, true},
+		{"purge mapped to a wide ban", "PURGE", "/.*", nil, "", &dao.RewriteRules{Methods: map[string]string{"PURGE": "BAN"}}, true},
+		{"purge of the root with a prefix added", "PURGE", "/", nil, "", &dao.RewriteRules{AddPrefix: "/staging"}, true},
+		{"wide ban with a prefix added", "BAN", "/.*", nil, "", &dao.RewriteRules{AddPrefix: "/staging"}, true},
+		{"ban of a section", "BAN", "/news/.*", nil, "", nil, false},
+		{"ban of everything", "BAN", "/.*", nil, "", nil, true},
+		{"ban anchored", "BAN", "/^/.*$", nil, "", nil, true},
+		{"ban in a header", "BAN", "/page", http.Header{"X-Ban-Url": {"^/.*$"}}, "", nil, true},
+		{"ban expression in a header", "BAN", "/page", http.Header{"X-Ban": {`req.url ~ "."`}}, "", nil, true},
+		{"narrow ban in a header", "BAN", "/page", http.Header{"X-Ban-Url": {"^/news"}}, "", nil, false},
+		{"wide pattern outside of a ban header", "BAN", "/page", http.Header{"X-Other": {".*"}}, "", nil, false},
+		{"ban in the body", "BAN", "/page", nil, "req.http.host == example.com\nreq.url ~ .*\n", nil, true},
+		{"narrow ban in the body", "BAN", "/page", nil, "req.url ~ ^/news\n", nil, false},
+		{"wide body of a purge", "PURGE", "/page", nil, "req.url ~ .*", nil, false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		for k, v := range tt.header {
+			r.Header[k] = v
+		}
+
+		br := newBroadcastRequest(r, dao.PriorityNormal)
+		br.Body = newMemoryBody([]byte(tt.body), "text/plain")
+
+		cache := dao.Cache{Name: "Cache1", Address: "http://127.0.0.1:7001", Rewrite: tt.rewrite}
+		reason := destructiveRequest(br.Path, cacheRequest(br, cache), br.Body)
+
+		if got := reason != ""; got != tt.want {
+			t.Errorf("%s: got %q, want destructive %v", tt.name, reason, tt.want)
+		}
+	}
+}
+
+func TestGuardRejectsABanInTheBody(t *testing.T) {
+	cache := testCache(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("%s %s reached the cache", r.Method, r.URL.Path)
+	})
+	useGroups(t, dao.Group{Name: "prod", Caches: []dao.Cache{cache}})
+
+	saved := *guardrails
+	*guardrails = true
+	defer func() { *guardrails = saved }()
+
+	r := httptest.NewRequest("BAN", "/page", strings.NewReader("req.url ~ .*\n"))
+	r.Header.Set("X-Group", "prod")
+	w := httptest.NewRecorder()
+	reqHandler(w, r)
+
+	if w.Code != http.StatusPreconditionRequired {
+		t.Errorf("got a %d, want a 428: %s", w.Code, w.Body)
+	}
+}
+
+func TestGuardMaxCachesAcrossRoutes(t *testing.T) {
+	var shared, prod, eu hostRecorder
+
+	sharedCache := shared.cache(t, http.StatusOK)
+	useGroups(t,
+		dao.Group{Name: "prod", Hosts: []string{"www.example.com"}, Caches: []dao.Cache{prod.cache(t, http.StatusOK), sharedCache}},
+		dao.Group{Name: "eu", Hosts: []string{"www.example.eu"}, Caches: []dao.Cache{eu.cache(t, http.StatusOK), sharedCache}},
+	)
+
+	savedGuardrails, savedMax := *guardrails, *guardMaxCaches
+	*guardrails, *guardMaxCaches = true, 2
+	defer func() { *guardrails, *guardMaxCaches = savedGuardrails, savedMax }()
+
+	tests := []struct {
+		name string
+		send func(w http.ResponseWriter)
+	}{
+		{"broadcast", func(w http.ResponseWriter) {
+			r := httptest.NewRequest("PURGE", "/page", nil)
+			r.Header.Set("X-Hosts", "www.example.com, www.example.eu")
+			reqHandler(w, r)
+		}},
+		{"bulk", func(w http.ResponseWriter) {
+			r := httptest.NewRequest(http.MethodPost, "/bulk", strings.NewReader(`{"path": "/a", "host": "www.example.com"}`+"\n"+`{"path": "/b", "host": "www.example.eu"}`+"\n"))
+			bulkHandler(w, r)
+		}},
+		{"urls", func(w http.ResponseWriter) {
+			r := httptest.NewRequest(http.MethodPost, "/urls", strings.NewReader("https://www.example.com/a\nhttps://www.example.eu/b\n"))
+			urlsHandler(w, r)
+		}},
+	}
+
+	// Each group is within the limit, but not the three caches
+	// they make together.
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		tt.send(w)
+
+		if w.Code != http.StatusPreconditionRequired || !strings.Contains(w.Body.String(), "3 caches") {
+			t.Errorf("%s: got a %d: %s", tt.name, w.Code, w.Body)
+		}
+	}
+	if prod.received() != "" || eu.received() != "" || shared.received() != "" {
+		t.Error("a rejected broadcast reached the caches")
+	}
+
+	// The shared cache is counted once.
+	*guardMaxCaches = 3
+	w := httptest.NewRecorder()
+	tests[0].send(w)
+	if w.Code != http.StatusOK {
+		t.Errorf("got a %d within the limit: %s", w.Code, w.Body)
+	}
+}
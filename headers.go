@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+// hopByHopHeaders only make sense between the client and the
+// broadcaster, along with the ones listed in Connection.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// controlHeaders are meant for the broadcaster itself.
+var controlHeaders = []string{
+	"Content-Length",
+	"X-Async",
+	"X-Callback-Url",
+	"X-Client-Id",
+	"X-Confirm",
+	"X-Delay",
+	"X-Dry-Run",
+	"X-Group",
+	"X-Guard-Token",
+	"X-Hosts",
+	"X-Invalidate",
+	"X-Keys",
+	"X-Method",
+	"X-Priority",
+	"X-Schedule-At",
+	"X-Timeout",
+}
+
+// credentialHeaders are only forwarded to the caches of groups
+// which allow them explicitly, and are not written to disk along
+// with a scheduled broadcast, which runs without them.
+var credentialHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Proxy-Authorization",
+}
+
+// forwardedHeaders returns a copy of the headers of the client to
+// send to a cache, without the hop-by-hop and control headers and
+// according to the policy of the group, if any. Credentials are
+// dropped unless the policy allows them. Every value of a header
+// is kept.
+func forwardedHeaders(h http.Header, policy *dao.HeaderPolicy) http.Header {
+	var (
+		out     = make(http.Header, len(h))
+		dropped = make(map[string]bool)
+	)
+
+	for _, name := range append(hopByHopHeaders, controlHeaders...) {
+		dropped[name] = true
+	}
+	for _, value := range h["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			dropped[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+
+	for _, name := range credentialHeaders {
+		if policy == nil || !policy.Allows(name) {
+			dropped[name] = true
+		}
+	}
+
+	for name, values := range h {
+		if dropped[name] || (policy != nil && !policy.Forwards(name)) {
+			continue
+		}
+		out[name] = append([]string(nil), values...)
+	}
+
+	return out
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+func TestForwardedHeaders(t *testing.T) {
+	h := http.Header{
+		"Connection":          {"keep-alive, X-Session"},
+		"Keep-Alive":          {"timeout=5"},
+		"Transfer-Encoding":   {"chunked"},
+		"Proxy-Authorization": {"Basic Zm9vOmJhcg=="},
+		"X-Session":           {"abc"},
+		"X-Group":             {"prod"},
+		"X-Timeout":           {"1s"},
+		"Authorization":       {"Bearer token"},
+		"Cookie":              {"session=abc"},
+		"X-Tags":              {"product-1", "product-2"},
+	}
+
+	out := forwardedHeaders(h, nil)
+
+	// Hop-by-hop, Connection-listed, control and credential
+	// headers are dropped.
+	if len(out) != 1 {
+		t.Errorf("got the headers %v, want X-Tags only", out)
+	}
+	if got := out["X-Tags"]; len(got) != 2 || got[0] != "product-1" || got[1] != "product-2" {
+		t.Errorf("X-Tags: got %v, want every value", got)
+	}
+}
+
+func TestForwardedHeadersPolicy(t *testing.T) {
+	h := http.Header{
+		"Authorization": {"Bearer token"},
+		"Cookie":        {"session=abc"},
+		"X-Tags":        {"product-1"},
+		"X-Debug":       {"1"},
+	}
+
+	out := forwardedHeaders(h, &dao.HeaderPolicy{Allow: []string{"Authorization", "X-Tags"}})
+	if len(out) != 2 || out.Get("Authorization") != "Bearer token" || out.Get("X-Tags") != "product-1" {
+		t.Errorf("allowed: got the headers %v", out)
+	}
+
+	out = forwardedHeaders(h, &dao.HeaderPolicy{Deny: []string{"X-Debug"}})
+	if len(out) != 1 || out.Get("X-Tags") != "product-1" {
+		t.Errorf("denied: got the headers %v, want the credentials dropped too", out)
+	}
+
+	out = forwardedHeaders(h, &dao.HeaderPolicy{Allow: []string{"Cookie"}, Deny: []string{"Cookie"}})
+	if len(out) != 0 {
+		t.Errorf("allowed and denied: got the headers %v", out)
+	}
+}
+
+func TestForwardedHeadersAreCopies(t *testing.T) {
+	h := http.Header{"X-Tags": {"product-1"}}
+	br := broadcastRequest{Method: "PURGE", Path: "/page", Headers: h, IntentHeaders: map[string]string{"X-Purge-Mode": "soft"}}
+
+	var (
+		first  = cacheRequest(br, dao.Cache{Name: "Cache1"})
+		second = cacheRequest(br, dao.Cache{Name: "Cache2"})
+	)
+
+	first.Headers.Set("X-Rewritten", "1")
+	first.Headers["X-Tags"][0] = "changed"
+
+	if second.Headers.Get("X-Rewritten") != "" || second.Headers.Get("X-Tags") != "product-1" {
+		t.Errorf("the headers of a job leaked into another: %v", second.Headers)
+	}
+	if h.Get("X-Tags") != "product-1" || h.Get("X-Purge-Mode") != "" {
+		t.Errorf("the headers of the client changed: %v", h)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+var testCaches int32
+
+// testCache starts a cache answering with handler and returns it,
+// ready to be broadcasted to.
+func testCache(t *testing.T, handler http.HandlerFunc) dao.Cache {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	cache := dao.Cache{Name: fmt.Sprintf("Cache%d", atomic.AddInt32(&testCaches, 1)), Address: srv.URL}
+	warmUpHttpClient(cache)
+	useQueue(t, cache)
+	return cache
+}
+
+// useQueue gives the cache a queue, as configured caches get one,
+// and retires it once the test is done.
+func useQueue(t *testing.T, cache dao.Cache) *cacheQueue {
+	q := newCacheQueue(cache)
+
+	queuesLocker.Lock()
+	queues[cache.Address] = q
+	queuesLocker.Unlock()
+
+	t.Cleanup(func() {
+		queuesLocker.Lock()
+		delete(queues, cache.Address)
+		queuesLocker.Unlock()
+		q.retire()
+	})
+	return q
+}
+
+// testGroup returns a group made of the caches.
+func testGroup(caches ...dao.Cache) dao.Group {
+	return dao.Group{Name: "test", Caches: caches}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+// hostResult is the outcome of a broadcast for one of the hosts
+// it was sent for.
+type hostResult struct {
+	Host      string         `json:"host"`
+	Status    int            `json:"status"`
+	PolicyMet *bool          `json:"policy_met,omitempty"`
+	Caches    map[string]int `json:"caches"`
+	Stages    []stageResult  `json:"stages,omitempty"`
+}
+
+// requestHosts returns the hosts listed in the X-Hosts header,
+// without duplicates.
+func requestHosts(r *http.Request) []string {
+	var (
+		hosts []string
+		seen  = make(map[string]bool)
+	)
+
+	for _, value := range r.Header.Values("X-Hosts") {
+		for _, host := range strings.Split(value, ",") {
+			if host = strings.TrimSpace(host); host != "" && !seen[host] {
+				seen[host] = true
+				hosts = append(hosts, host)
+			}
+		}
+	}
+
+	return hosts
+}
+
+// broadcastHosts broadcasts br once for each of its hosts, at the
+// same time. Each host is judged on its own against the policy of
+// the group, which is met only if it is met for every host.
+func broadcastHosts(ctx context.Context, br broadcastRequest, group dao.Group, progress func(cacheResult)) *broadcastResult {
+	var (
+		wg      sync.WaitGroup
+		results = make([]*broadcastResult, len(br.Hosts))
+		res     = &broadcastResult{policy: group.Policy}
+	)
+
+	for i, host := range br.Hosts {
+		hbr := br
+		hbr.Host, hbr.Hosts = host, nil
+
+		var hostProgress func(cacheResult)
+		if progress != nil {
+			hostProgress = func(cr cacheResult) {
+				cr.Host = hbr.Host
+				progress(cr)
+			}
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = broadcast(ctx, hbr, group, hostProgress)
+		}(i)
+	}
+
+	wg.Wait()
+
+	for i, hr := range results {
+		for _, cr := range hr.Caches {
+			cr.Host = br.Hosts[i]
+			res.Caches = append(res.Caches, cr)
+		}
+
+		res.Hosts = append(res.Hosts, hostResult{Host: br.Hosts[i], Status: hr.Status, PolicyMet: hr.PolicyMet, Caches: hr.codes(), Stages: hr.Stages})
+	}
+
+	res.Status, res.PolicyMet = combinedStatus(results, group.Policy)
+	return res
+}
+
+// hostCodes returns the status code received from each cache for
+// each host, the body of a broadcast sent for several hosts.
+func (res *broadcastResult) hostCodes() map[string]map[string]int {
+	var out = make(map[string]map[string]int, len(res.Hosts))
+
+	// A host served by several groups is reported once, along
+	// with the caches of all of them.
+	for _, hr := range res.Hosts {
+		if out[hr.Host] == nil {
+			out[hr.Host] = make(map[string]int, len(hr.Caches))
+		}
+		for name, code := range hr.Caches {
+			out[hr.Host][name] = code
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+// applyIntent translates the invalidation intent asked for, if any,
+// into the method and headers the group expects. keys replace the
+// placeholder found in the header values of the intent.
+func applyIntent(br *broadcastRequest, name, keys string, group dao.Group) error {
+	if name == "" {
+		return nil
+	}
+
+	name, err := dao.ParseIntent(name)
+	if err != nil {
+		return err
+	}
+
+	intent, err := group.Intent(name)
+	if err != nil {
+		return err
+	}
+
+	if keys = strings.TrimSpace(keys); keys == "" && intent.NeedsKeys() {
+		return fmt.Errorf("intent %s needs keys, given with the X-Keys header", name)
+	}
+
+	br.Method = intent.Method
+
+	// Kept apart from the headers of the client, so that the
+	// header policy of the group doesn't apply to them.
+	br.IntentHeaders = make(map[string]string, len(intent.Headers))
+	for k, v := range intent.Headers {
+		br.IntentHeaders[k] = strings.Replace(v, dao.KeysPlaceholder, keys, -1)
+	}
+
+	return nil
+}
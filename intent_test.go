@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+func TestApplyIntent(t *testing.T) {
+	group := dao.Group{Name: "prod", Intents: map[string]*dao.Intent{
+		dao.IntentSoft: {Method: "PURGE", Headers: map[string]string{"X-Purge-Mode": "soft"}},
+		dao.IntentXkey: {Method: "PURGE", Headers: map[string]string{"xkey-softpurge": dao.KeysPlaceholder}},
+	}}
+
+	br := broadcastRequest{Method: "GET"}
+	if err := applyIntent(&br, "", "", group); err != nil || br.Method != "GET" || br.IntentHeaders != nil {
+		t.Errorf("no intent: got %+v, %v", br, err)
+	}
+
+	if err := applyIntent(&br, "soft", "", group); err != nil || br.Method != "PURGE" || br.IntentHeaders["X-Purge-Mode"] != "soft" {
+		t.Errorf("soft: got %+v, %v", br, err)
+	}
+
+	br = broadcastRequest{Method: "GET"}
+	if err := applyIntent(&br, "xkey", " product-1 product-2 ", group); err != nil || br.IntentHeaders["xkey-softpurge"] != "product-1 product-2" {
+		t.Errorf("xkey: got %+v, %v", br, err)
+	}
+
+	for _, tt := range []struct{ intent, keys string }{
+		{"xkey", " "},
+		{"ban", ""},
+		{"refresh", ""},
+	} {
+		if err := applyIntent(&broadcastRequest{}, tt.intent, tt.keys, group); err == nil {
+			t.Errorf("%s with keys %q: accepted", tt.intent, tt.keys)
+		}
+	}
+}
+
+func TestIntentReachesTheCaches(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	cache := testCache(t, func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+	})
+	cache.Forward = &dao.HeaderPolicy{}
+	useGroups(t, dao.Group{Name: "prod", Caches: []dao.Cache{cache}, Intents: map[string]*dao.Intent{
+		dao.IntentXkey: {Method: "PURGE", Headers: map[string]string{"xkey-softpurge": dao.KeysPlaceholder}},
+	}})
+
+	r := httptest.NewRequest(http.MethodGet, "/page", nil)
+	r.Header.Set("X-Group", "prod")
+	r.Header.Set("X-Invalidate", "xkey")
+	r.Header.Set("X-Keys", "product-1")
+	w := httptest.NewRecorder()
+	reqHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got a %d: %s", w.Code, w.Body.String())
+	}
+
+	// The intent headers are sent whatever the header policy.
+	got := <-received
+	if got.Method != "PURGE" || got.Header.Get("xkey-softpurge") != "product-1" {
+		t.Errorf("the cache got a %s with the headers %v", got.Method, got.Header)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/page", nil)
+	r.Header.Set("X-Group", "prod")
+	r.Header.Set("X-Invalidate", "xkey")
+	w = httptest.NewRecorder()
+	reqHandler(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("without keys: got a %d, want a 400", w.Code)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -16,7 +17,6 @@ import (
 	"os/signal"
 	"runtime"
 	"strconv"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -38,14 +38,40 @@ var (
 
 	commandLine   = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	port          = commandLine.Int("port", 8088, "Broadcaster port.")
-	grCount       = commandLine.Int("goroutines", 8, "Job handling goroutines pool. Higher is not implicitly better!")
-	reqRetries    = commandLine.Int("retries", 1, "Request retry times against a cache - should the first attempt fail.")
+	apiPort       = commandLine.Int("api-port", 8089, "Broadcaster API port.")
+	grCount       = commandLine.Int("goroutines", 8, "Job handling goroutines of each cache, for groups without queue settings. Higher is not implicitly better!")
+	reqRetries    = commandLine.Int("retries", 1, "Request retry times against a cache - should the first attempt fail. Default for groups without a retry policy.")
 	cachesCfgFile = commandLine.String("cfg", "/caches.ini", "Path pointing to the caches configuration file.")
 	logFilePath   = commandLine.String("log-file", "", "Log file path.")
 	enforceStatus = commandLine.Bool("enforce", false, "Enforces the status code of a request to be the first encountered non-200 received from a cache. Disabled by default.")
 	enableLog     = commandLine.Bool("enable-log", false, "Switches logging on/off. Disabled by default.")
+	gracePeriod   = commandLine.Duration("grace", 30*time.Second, "Time given to in-flight broadcasts to complete on shutdown.")
+	unmatchedHost = commandLine.String("unmatched-host", "all", "Target of the requests without X-Group whose host no group serves: all caches, reject, or the name of a group.")
+
+	guardrails     = commandLine.Bool("guardrails", false, "Rejects the destructive broadcasts unless confirmed. Disabled by default.")
+	guardMaxCaches = commandLine.Int("guard-max-caches", 0, "Number of caches above which a broadcast is destructive. No limit by default.")
+	guardToken     = commandLine.String("guard-token", "", "Token confirming a destructive broadcast through the X-Guard-Token header.")
+
+	auditLogPath = commandLine.String("audit-log", "", "Audit log file path, every broadcast being recorded as a JSON line. Disabled by default.")
+	auditMaxSize = commandLine.Int64("audit-max-size", 100<<20, "Size in bytes above which the audit log is rotated.")
+	auditBackups = commandLine.Int("audit-backups", 5, "Number of rotated audit logs kept.")
+
+	coalesceEnabled = commandLine.Bool("coalesce", true, "Identical requests arriving while a broadcast is in flight share its result.")
+	coalesceWindow  = commandLine.Duration("coalesce-window", 0, "Time to wait before broadcasting so identical requests can be coalesced. Disabled by default.")
+	asyncRetention  = commandLine.Duration("async-retention", 10*time.Minute, "How long the outcome of an asynchronous broadcast is kept.")
+	bulkConcurrency = commandLine.Int("bulk-concurrency", 4, "Maximum number of jobs of a bulk request handled at once against a cache.")
+	maxBodySize     = commandLine.Int64("max-body-size", 1<<20, "Maximum size in bytes of a request body forwarded to the caches.")
+	streamBodySize  = commandLine.Int64("stream-body-size", 0, "Size in bytes above which a request body is streamed to the caches from a temporary file rather than held in memory. Disabled by default.")
+
+	scheduleFile     = commandLine.String("schedule-file", "", "Path of the file the scheduled broadcasts are kept in. Defaults to scheduled.json next to the configuration file.")
+	fakeClockEnabled = commandLine.Bool("fake-clock", false, "Drives the scheduled broadcasts with a clock only moved through the API. For testing purposes.")
+
+	webhooks       = commandLine.String("webhooks", "", "Comma separated urls notified with a summary of every finished broadcast.")
+	webhookSecret  = commandLine.String("webhook-secret", "", "Secret used to sign the webhook payloads. Payloads are not signed by default.")
+	webhookRetries = commandLine.Int("webhook-retries", 3, "Delivery retry times against a webhook - should the first attempt fail.")
+	webhookBackoff = commandLine.Duration("webhook-backoff", time.Second, "Delay before the first webhook delivery retry, doubled on each further retry.")
+	callbackHosts  = commandLine.String("callback-hosts", "", "Comma separated hosts X-Callback-Url may point to. Callbacks are refused by default.")
 
-	jobChannel = make(chan *Job, 2<<12)
 	logChannel = make(chan []string, 2<<12)
 	sigChannel = make(chan os.Signal, 1)
 	hupChannel = make(chan os.Signal, 1)
@@ -78,13 +104,68 @@ func createHTTPClient() *http.Client {
 }
 
 type Job struct {
+	Ctx    context.Context
 	Cache  dao.Cache
 	Status chan int
 	Result chan []byte
+	// Body sent along with the request, if any.
+	Body *requestBody
+	// Lane of the queue the job goes to, and when it got there.
+	Priority int
+	Queued   time.Time
+}
+
+// broadcastRequest describes the request sent to each cache.
+type broadcastRequest struct {
+	Method  string
+	Path    string
+	Query   string
+	Host    string
+	Headers http.Header
+	// Hosts the request is broadcasted for, when there are several.
+	Hosts []string
+	// Headers the invalidation intent asked for requires.
+	IntentHeaders map[string]string
+	// Priority of the jobs against the caches.
+	Priority string
+	// Body forwarded to the caches, if any.
+	Body *requestBody
+}
+
+func newBroadcastRequest(r *http.Request, priority string) broadcastRequest {
+	br := broadcastRequest{
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Query:    r.URL.RawQuery,
+		Host:     r.Host,
+		Headers:  r.Header,
+		Priority: priority,
+	}
+
+	switch hosts := requestHosts(r); {
+	case len(hosts) == 1:
+		br.Host = hosts[0]
+	case len(hosts) > 1:
+		br.Hosts = hosts
+	}
+
+	return br
+}
+
+// complete reports the outcome of the job. A failed job still
+// reports a status, otherwise the broadcast waiting on it, and any
+// request coalesced with it, would never complete.
+func (job *Job) complete(status int, err error) {
+	if err != nil {
+		job.Result <- []byte(err.Error())
+	}
+	job.Status <- status
+	pendingJobs.Done()
 }
 
-func newJob(cache dao.Cache) *Job {
+func newJob(ctx context.Context, cache dao.Cache) *Job {
 	job := Job{}
+	job.Ctx = ctx
 	job.Cache = cache
 	job.Result = make(chan []byte, 1)
 	job.Status = make(chan int, 1)
@@ -127,26 +208,31 @@ func notifySigHup() {
 				fmt.Println(err.Error())
 				os.Exit(1)
 			}
+
+			setUpQueues()
+			setUpBreakers()
+			setUpCrons()
 		}
 	}()
 }
 
-// notifySigChannel waits for an Interrupt or Kill signal
-// and gracefully handles it.
+// notifySigChannel waits for an Interrupt or Terminate signal
+// and gracefully handles it. A second signal forces the exit.
 func notifySigChannel() {
-	signal.Notify(sigChannel, os.Interrupt, os.Kill)
+	signal.Notify(sigChannel, os.Interrupt, syscall.SIGTERM)
 
-	go func(f *os.File) {
+	go func() {
 		<-sigChannel
-		if *enableLog {
-			if f != nil {
-				f.Close()
-			}
-		}
 
-		fmt.Println("Broadcaster exited succesfully.")
-		os.Exit(0)
-	}(logFile)
+		go func() {
+			<-sigChannel
+			fmt.Println("Broadcaster forced to exit.")
+			os.Exit(1)
+		}()
+
+		shutdown()
+		close(shutdownDone)
+	}()
 }
 
 // startLog initializes and starts a goroutine that's going
@@ -157,15 +243,21 @@ func startLog() error {
 
 	if *logFilePath != "" {
 		var logFileErr error
-		logWriter, logFileErr = os.OpenFile(*logFilePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		logFile, logFileErr = os.OpenFile(*logFilePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 
 		if logFileErr != nil {
 			return logFileErr
 		}
+		logWriter = logFile
 	}
 
 	go func(f io.WriteCloser) {
 		for logEntry := range logChannel {
+			if logEntry == nil {
+				close(logFlushed)
+				continue
+			}
+
 			logBuffer.Reset()
 			logBuffer.WriteString(time.Now().Format(time.RFC3339))
 			logBuffer.WriteString(" ")
@@ -181,159 +273,542 @@ func startLog() error {
 	return nil
 }
 
-func doRequest(cache dao.Cache) (int, error) {
+// outgoingHeaders returns the headers of the request sent to the
+// cache, the Host one aside.
+func outgoingHeaders(cache dao.Cache, body *requestBody) http.Header {
+	var header = make(http.Header)
+
+	// Preserve the headers, every value of them
+	for k, v := range cache.Headers {
+		header[k] = v
+	}
+	// The "Host" header is the hardest
+	header.Set("X-Host", cache.Host)
+
+	if body != nil && body.contentType != "" {
+		header.Set("Content-Type", body.contentType)
+	}
+	return header
+}
+
+// doRequest sends the request to the cache and returns the status
+// code along with the headers of the response.
+func doRequest(ctx context.Context, cache dao.Cache, body *requestBody) (int, http.Header, error) {
 	locker.Lock()
 	client := clients[cache.Name]
 	locker.Unlock()
 
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = body.open()
+	}
+
 	reqString := cache.Address + cache.Item
-	r, err := http.NewRequest(cache.Method, reqString, nil)
+	r, err := http.NewRequestWithContext(ctx, cache.Method, reqString, reqBody)
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
 	r.URL.RawQuery = cache.Parameters
 
-	// Preserve the headers
-	for k, v := range cache.Headers {
-		r.Header.Set(k, strings.Join(v, " "))
-	}
-	// The "Host" header is the hardest
-	r.Header.Set("X-Host", cache.Headers.Get("Host"))
-	r.Host = cache.Headers.Get("Host")
+	r.Header = outgoingHeaders(cache, body)
+	r.Host = cache.Host
 
-	if err != nil {
-		return http.StatusInternalServerError, err
+	// The body is replayed as is, redirects included
+	if body != nil {
+		r.ContentLength = body.size
+		r.GetBody = func() (io.ReadCloser, error) {
+			return body.open(), nil
+		}
 	}
 
 	resp, err := client.Do(r)
 
 	if err != nil {
-		return http.StatusInternalServerError, err
+		return http.StatusInternalServerError, nil, err
 	}
 
 	_, err = io.Copy(ioutil.Discard, resp.Body)
 
 	if err != nil {
-		return http.StatusInternalServerError, err
+		return http.StatusInternalServerError, nil, err
 	}
 
 	resp.Body.Close()
 
-	return resp.StatusCode, err
+	return resp.StatusCode, resp.Header, err
 
 }
 
-// jobWorker listens on the jobs channel and handles
-// any incoming job.
-func jobWorker(jobs <-chan *Job) {
-	for job := range jobs {
-		var out int
-		var err error
+// jobWorker takes the jobs out of the queue, highest priority
+// first, and handles them. Failed requests are retried according
+// to the retry policy of the group of the cache, unless the
+// circuit of the cache is open.
+func jobWorker(q *cacheQueue) {
+	for {
+		job, ok := q.next()
+		if !ok {
+			return
+		}
+		countHandled(job)
+
+		var (
+			out     int
+			header  http.Header
+			err     error
+			policy  = retryPolicy(job.Cache)
+			breaker = cacheBreaker(job.Cache)
+		)
+
+		if breaker != nil && !breaker.allow() {
+			job.complete(http.StatusServiceUnavailable, errCircuitOpen)
+			continue
+		}
+
+		for retry := 0; ; retry++ {
+			// Nobody is waiting for the outcome anymore.
+			if job.Ctx.Err() != nil {
+				out, err = http.StatusGatewayTimeout, job.Ctx.Err()
+				break
+			}
+
+			out, header, err = doRequest(job.Ctx, job.Cache, job.Body)
+
+			var errClass string
+			if err != nil {
+				errClass = errorClass(err)
+			}
+
+			if retry >= policy.Retries || job.Ctx.Err() != nil || !policy.ShouldRetry(out, errClass) {
+				break
+			}
+
+			// Connections kept alive may be stale, don't reuse them.
+			if errClass == dao.ErrorConnection {
+				closeIdleConnections(job.Cache)
+			}
 
-		for i := 0; i <= *reqRetries; i++ {
-			out, err = doRequest(job.Cache)
-			if err == nil {
+			if !sleep(job.Ctx, retryDelay(policy, retry, header)) {
 				break
+			}
+		}
+
+		if breaker != nil {
+			if job.Ctx.Err() != nil {
+				breaker.release()
 			} else {
-				// TODO: still need to decide what to do here.
-				err = warmUpHttpClient(job.Cache)
-				if err != nil {
-					break
-				}
+				breaker.record(err != nil || out >= http.StatusInternalServerError)
 			}
 		}
 
-		if err != nil {
-			job.Result <- []byte(err.Error())
-			continue
+		job.complete(out, err)
+	}
+}
+
+// targetGroup returns the group of the given name or, if no
+// name is given, an unnamed group holding all caches.
+func targetGroup(groupName string) (dao.Group, error) {
+	if groupName == "" {
+		return dao.Group{Caches: allCaches}, nil
+	}
+
+	locker.Lock()
+	defer locker.Unlock()
+
+	if _, found := groups[groupName]; !found {
+		return dao.Group{}, fmt.Errorf("Group %s not found.", groupName)
+	}
+
+	return groups[groupName], nil
+}
+
+// broadcastRun broadcasts a request until ctx is done or the
+// requested deadline passes, whichever comes first.
+type broadcastRun func(ctx context.Context, progress func(cacheResult)) *broadcastResult
+
+// groupRequest turns a request into the one sent to the caches of
+// the group, according to the invalidation intent and the priority
+// it asks for.
+func groupRequest(r *http.Request, group dao.Group, body *requestBody) (broadcastRequest, error) {
+	var err error
+
+	br := newBroadcastRequest(r, "")
+	br.Body = body
+	if err = applyIntent(&br, r.Header.Get("X-Invalidate"), r.Header.Get("X-Keys"), group); err != nil {
+		return br, err
+	}
+
+	br.Priority, err = requestPriority(r, group, br.Method, dao.PriorityNormal)
+	return br, err
+}
+
+// prepareBroadcast reads the deadline, the invalidation intent and
+// the priority asked for by the request, and returns the run
+// broadcasting it against the groups it is routed to.
+func prepareBroadcast(id string, r *http.Request, routes []groupRoute, body *requestBody) (broadcastRun, error) {
+	timeout, err := broadcastTimeout(r)
+	if err != nil {
+		return nil, err
+	}
+
+	reqs, err := routeRequests(r, routes, body)
+	if err != nil {
+		return nil, err
+	}
+
+	run := func(ctx context.Context, progress func(cacheResult)) *broadcastResult {
+		if !*coalesceEnabled {
+			ctx, cancel := withTimeout(ctx, timeout)
+			defer cancel()
+
+			return broadcastRoutes(ctx, routes, reqs, progress)
 		}
-		job.Status <- out
+
+		res, shared := coalesce(ctx, coalesceKey(routesName(routes), r, body), func(ctx context.Context) *broadcastResult {
+			ctx, cancel := withTimeout(ctx, timeout)
+			defer cancel()
+
+			return broadcastRoutes(ctx, routes, reqs, progress)
+		})
+
+		if shared {
+			sendToLogChannel(r.Method, " ", r.URL.Path, " coalesced with an in-flight broadcast.\n")
+		}
+		if res == nil {
+			return unfinishedRoutes(ctx, routes)
+		}
+		return res
 	}
+
+	// Each request is audited, coalesced or not, with a record
+	// for each group it is routed to.
+	return func(ctx context.Context, progress func(cacheResult)) *broadcastResult {
+		defer body.release()
+
+		started := time.Now()
+		res := run(ctx, progress)
+
+		var parts = res.parts
+		if parts == nil {
+			parts = []*broadcastResult{res}
+		}
+		for i, route := range routes {
+			writeAudit(newAuditRecord(id, r, route.name, reqs[i], route.group, started, parts[i].Status, parts[i].Caches))
+		}
+		return res
+	}, nil
 }
 
 // reqHandler handles any incoming http request. Its main purpose
 // is to distribute the request further to all required caches.
 func reqHandler(w http.ResponseWriter, r *http.Request) {
 
+	routes, err := requestRoutes(r)
+	if err != nil {
+		sendToLogChannel(err.Error())
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
 	var (
-		groupName       string
-		reqId           string
-		broadcastCaches []dao.Cache
-		reqStatusCode   = http.StatusOK
-		respBody        = make(map[string]int)
+		groupName  = routesName(routes)
+		cacheCount = routesCaches(routes)
 	)
 
-	for k, v := range r.Header {
-		if strings.ToLower(k) == "x-group" {
-			groupName = v[0]
-			break
-		}
+	if cacheCount == 0 {
+		sendToLogChannel("Group ", groupName, " has no configured caches.")
+		w.WriteHeader(http.StatusNoContent)
+		return
 	}
 
-	if groupName == "" {
-		broadcastCaches = allCaches
-	} else {
-		locker.Lock()
-		if _, found := groups[groupName]; !found {
-			var errText = fmt.Sprintf("Group %s not found.", groupName)
-			sendToLogChannel(errText)
-			http.Error(w, errText, http.StatusNotFound)
-			locker.Unlock()
+	at, err := scheduledAt(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := readRequestBody(r)
+	if err == errBodyTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not read the request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if isDryRun(r) {
+		writeDryRun(w, r, routes, body)
+		body.release()
+		return
+	}
+
+	if err = guardRequest(r, routes, body); err != nil {
+		body.release()
+		sendToLogChannel("Rejected: ", err.Error(), "\n")
+		http.Error(w, err.Error(), http.StatusPreconditionRequired)
+		return
+	}
+
+	hooks, err := webhookUrls(r)
+	if err != nil {
+		body.release()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var id = newBroadcastId()
+
+	run, err := prepareBroadcast(id, r, routes, body)
+	if err != nil {
+		body.release()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("X-Broadcast-Id", id)
+
+	// Scheduled broadcasts run asynchronously once due.
+	if !at.IsZero() {
+		sb, err := scheduleBroadcast(id, r, groupName, at, body)
+		body.release()
+		if err != nil {
+			sendToLogChannel("Scheduling failed: ", err.Error(), "\n")
+			http.Error(w, "Could not schedule the broadcast: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
-		broadcastCaches = groups[groupName].Caches
-		locker.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		out, _ := json.MarshalIndent(map[string]interface{}{"id": sb.ID, "at": sb.At}, "", "  ")
+		w.Write(out)
+		return
 	}
 
-	var cacheCount = len(broadcastCaches)
+	// Asynchronous broadcasts outlive the request.
+	if isAsync(r) {
+		ab := startAsyncBroadcast(id, r, groupName, hooks, func() *broadcastResult {
+			return run(context.Background(), nil)
+		})
 
-	if cacheCount == 0 {
-		sendToLogChannel("Group ", groupName, " has no configured caches.")
-		w.WriteHeader(http.StatusNoContent)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		out, _ := json.MarshalIndent(map[string]string{"id": ab.ID}, "", "  ")
+		w.Write(out)
+		return
+	}
+
+	var (
+		started = time.Now()
+		stream  = newProgressStream(w, r)
+		res     *broadcastResult
+	)
+
+	if stream != nil {
+		res = run(r.Context(), stream.result)
+		stream.finish(res)
+	} else {
+		res = run(r.Context(), nil)
+	}
+
+	if len(hooks) > 0 {
+		deliverWebhooks(hooks, newWebhookPayload(id, r.Method, r.URL.Path, groupName, started, time.Now(), res))
+	}
+
+	if stream != nil {
 		return
 	}
 
-	var jobs = make([]*Job, cacheCount)
+	w.Header().Set("Content-Type", "application/json")
+	if res.PolicyMet != nil {
+		w.Header().Set("X-Policy-Met", strconv.FormatBool(*res.PolicyMet))
+	}
+	if len(res.Stages) > 0 {
+		w.Header().Set("X-Stages", stagesHeader(res.Stages))
+	}
+	w.WriteHeader(res.Status)
+
+	var codes interface{} = res.codes()
+	if len(res.Hosts) > 0 {
+		codes = res.hostCodes()
+	}
+
+	out, _ := json.MarshalIndent(codes, "", "  ")
+	w.Write(out)
+}
+
+// dispatch creates the job sending br to the cache and hands it
+// over to the queue of the cache.
+func dispatch(ctx context.Context, br broadcastRequest, cache dao.Cache) *Job {
+	job := newJob(ctx, cacheRequest(br, cache))
+	job.Body = br.Body
+	job.Priority = priorityLane(br.Priority)
+	pendingJobs.Add(1)
+	enqueue(job)
+	return job
+}
 
-	for idx, bc := range broadcastCaches {
-		bc.Method = r.Method
-		bc.Item = r.URL.Path
-		bc.Parameters = r.URL.RawQuery
-		bc.Headers = r.Header
-		if len(r.Host) != 0 {
-			bc.Headers.Add("Host", r.Host)
+// cacheRequest returns the cache set up with the request it is
+// sent, rewritten according to the rules of the group of the cache.
+// Each cache gets headers of its own, those the group forwards.
+func cacheRequest(br broadcastRequest, cache dao.Cache) dao.Cache {
+	cache.Method = br.Method
+	cache.Item = br.Path
+	cache.Parameters = br.Query
+	cache.Host = br.Host
+	cache.Headers = forwardedHeaders(br.Headers, cache.Forward)
+
+	for k, v := range br.IntentHeaders {
+		cache.Headers.Set(k, v)
+	}
+
+	if cache.Rewrite != nil {
+		cache.Rewrite.Apply(&cache)
+	}
+
+	return cache
+}
+
+// waitJob waits for the job to be handled and returns its outcome,
+// or gives up on it as soon as its context is done.
+func waitJob(job *Job) cacheResult {
+	select {
+	case status := <-job.Status:
+		cr := cacheResult{Name: job.Cache.Name, Address: job.Cache.Address, Status: status}
+
+		// The error, if any, is sent before the status.
+		select {
+		case msg := <-job.Result:
+			cr.Error = string(msg)
+		default:
 		}
 
-		job := newJob(bc)
-		jobs[idx] = job
-		jobChannel <- job
+		return cr
+	case <-job.Ctx.Done():
+		return unfinishedResult(job.Ctx, job.Cache)
 	}
+}
+
+// broadcast creates a job for each of the caches of the group, hands
+// them over to the workers and collects their outcome. If given,
+// progress is called with the outcome of each cache as soon as it
+// is known.
+//
+// The stages of the group, if any, are broadcasted to one after the
+// other. Once one fails to meet the policy, the caches of the next
+// ones are skipped. Once the context is done, the caches which did
+// not answer yet are reported as timed out.
+func broadcast(ctx context.Context, br broadcastRequest, group dao.Group, progress func(cacheResult)) *broadcastResult {
+	if len(br.Hosts) > 0 {
+		return broadcastHosts(ctx, br, group, progress)
+	}
+
+	var (
+		reqId       string
+		caches      = group.Caches
+		res         = &broadcastResult{Status: http.StatusOK, Caches: make([]cacheResult, len(caches)), policy: group.Policy}
+		failedStage string
+	)
 
 	if *enableLog {
 		reqId = hash(hash(time.Now().String()))
 	}
 
-	for _, job := range jobs {
+	var report = func(cr cacheResult) {
+		if progress != nil {
+			progress(cr)
+		}
+		sendToLogChannel(reqId, " ", br.Method, " ", cr.Address, br.Path, " ", "\n")
+	}
 
-		jobStatusCode := <-job.Status
+	for stage, indexes := range group.StageCaches() {
+		var outcomes = make([]cacheResult, len(indexes))
+
+		if failedStage != "" {
+			for i, idx := range indexes {
+				outcomes[i] = skippedResult(caches[idx], failedStage)
+				res.Caches[idx] = outcomes[i]
+				report(outcomes[i])
+			}
+		} else {
+			broadcastStage(ctx, br, caches, indexes, outcomes, report)
+			for i, idx := range indexes {
+				res.Caches[idx] = outcomes[i]
+			}
+		}
 
-		if *enforceStatus && reqStatusCode == http.StatusOK {
-			reqStatusCode = jobStatusCode
+		if len(group.Stages) == 0 {
+			continue
 		}
 
-		respBody[job.Cache.Name] = jobStatusCode
-		sendToLogChannel(reqId, " ", r.Method, " ", job.Cache.Address, r.URL.Path, " ", "\n")
+		sr := newStageResult(group.Stages[stage].Name, outcomes, stagePolicy(group), failedStage != "")
+		res.Stages = append(res.Stages, sr)
+
+		if !sr.PolicyMet && failedStage == "" {
+			failedStage = sr.Name
+		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(reqStatusCode)
+	res.applyPolicy()
 
-	out, _ := json.MarshalIndent(respBody, "", "  ")
-	w.Write(out)
+	return res
+}
+
+// broadcastStage dispatches a job to each of the caches at the
+// given indexes and waits for their outcome, which report is
+// called with as soon as it is known.
+func broadcastStage(ctx context.Context, br broadcastRequest, caches []dao.Cache, indexes []int, outcomes []cacheResult, report func(cacheResult)) {
+	var done = make(chan int, len(indexes))
+
+	for i, idx := range indexes {
+		go func(i int, job *Job) {
+			outcomes[i] = waitJob(job)
+			done <- i
+		}(i, dispatch(ctx, br, caches[idx]))
+	}
+
+	for range indexes {
+		report(outcomes[<-done])
+	}
 }
 
-func startBroadcastServer() {
+// startApiServer serves the broadcaster's own endpoints. These are
+// kept apart from the broadcast port, where any path is meant for
+// the caches.
+func startApiServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/audit", auditHandler)
+	mux.HandleFunc("/broadcasts/", broadcastStatusHandler)
+	mux.HandleFunc("/bulk", bulkHandler)
+	mux.HandleFunc("/circuits", circuitsHandler)
+	mux.HandleFunc("/crons", cronsHandler)
+	mux.HandleFunc("/dry-run/", dryRunHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/queues", queuesHandler)
+	mux.HandleFunc("/schedules", schedulesHandler)
+	mux.HandleFunc("/schedules/", scheduleHandler)
+	mux.HandleFunc("/urls", urlsHandler)
+
+	if *fakeClockEnabled {
+		mux.HandleFunc("/clock", clockHandler)
+	}
+
+	apiServer = &http.Server{Addr: ":" + strconv.Itoa(*apiPort), Handler: mux}
+
+	fmt.Fprintf(os.Stdout, "Broadcaster API serving on %s...\n", strconv.Itoa(*apiPort))
+	go func() {
+		if err := apiServer.ListenAndServe(); err != http.ErrServerClosed {
+			fmt.Println(err)
+		}
+	}()
+}
+
+func startBroadcastServer() error {
 	http.HandleFunc("/", reqHandler)
 
+	broadcastServer = &http.Server{Addr: ":" + strconv.Itoa(*port)}
+
 	fmt.Fprintf(os.Stdout, "Broadcaster serving on %s...\n", strconv.Itoa(*port))
-	fmt.Println(http.ListenAndServe(":"+strconv.Itoa(*port), nil))
+	return broadcastServer.ListenAndServe()
 }
 
 // setUpCaches reads the configured caches from the .ini file
@@ -342,15 +817,19 @@ func startBroadcastServer() {
 func readConfiguredCaches() error {
 	var (
 		newCaches []dao.Cache
+		newGroups = make(map[string]dao.Group)
 	)
 
 	locker.Lock()
 	defer locker.Unlock()
 
 	groupList, err := dao.LoadCachesFromIni(*cachesCfgFile)
+	if err != nil {
+		return err
+	}
 
 	for _, g := range groupList {
-		groups[g.Name] = g
+		newGroups[g.Name] = g
 
 		for _, cache := range g.Caches {
 			_, err = url.Parse(cache.Address)
@@ -362,12 +841,25 @@ func readConfiguredCaches() error {
 			newCaches = append(newCaches, cache)
 		}
 	}
-	// Replace cache list by the new one
+	// Replace cache list and groups by the new ones, so that
+	// removed groups are gone too.
 	allCaches = newCaches
+	groups = newGroups
+	hostRoutes = buildHostRoutes(newGroups)
 
 	return err
 }
 
+func closeIdleConnections(cache dao.Cache) {
+	locker.Lock()
+	client := clients[cache.Name]
+	locker.Unlock()
+
+	if client != nil {
+		client.CloseIdleConnections()
+	}
+}
+
 func warmUpHttpClient(cache dao.Cache) error {
 	locker.Lock()
 	client := createHTTPClient()
@@ -421,6 +913,9 @@ func main() {
 
 	fmt.Println("Loading configuration.")
 
+	dao.DefaultRetries = *reqRetries
+	dao.DefaultConcurrency = *grCount
+
 	err = readConfiguredCaches()
 	if err != nil {
 		fmt.Println(err.Error())
@@ -436,12 +931,31 @@ func main() {
 		os.Exit(1)
 	}
 
+	setUpQueues()
+	setUpBreakers()
+
+	if *fakeClockEnabled {
+		schedulerClock = newFakeClock(time.Now())
+	}
+
+	err = loadSchedules()
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	setUpCrons()
+
+	startApiServer()
+
 	notifySigHup()
 	notifySigChannel()
 
-	for i := 0; i < (*grCount); i++ {
-		go jobWorker(jobChannel)
+	if err = startBroadcastServer(); err != http.ErrServerClosed {
+		fmt.Println(err)
+		return
 	}
 
-	startBroadcastServer()
+	<-shutdownDone
+	fmt.Println("Broadcaster exited succesfully.")
 }
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricLabel quotes a label value as expected by the
+// Prometheus text format.
+func metricLabel(value string) string {
+	return `"` + metricLabelEscaper.Replace(value) + `"`
+}
+
+// metricsHandler serves GET /metrics, in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeBreakerMetrics(w)
+	writeQueueMetrics(w)
+	writePriorityMetrics(w)
+	writeScheduleMetrics(w)
+	writeCronMetrics(w)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+// priorityCounters keep track of the jobs handled out of the lanes
+// of a priority, and of the time they spent waiting in them.
+type priorityCounters struct {
+	handled int64
+	waited  int64
+}
+
+var priorityStats = make([]priorityCounters, len(dao.Priorities))
+
+// priorityLane returns the lane of the queues holding the jobs of
+// the given priority, lane 0 being handled first.
+func priorityLane(priority string) int {
+	for lane, p := range dao.Priorities {
+		if p == priority {
+			return lane
+		}
+	}
+	return priorityLane(dao.PriorityNormal)
+}
+
+// requestPriority returns the priority asked for through the
+// X-Priority header or, failing that, the one the group sets for
+// the method. If neither does, fallback applies.
+func requestPriority(r *http.Request, group dao.Group, method, fallback string) (string, error) {
+	if value := r.Header.Get("X-Priority"); value != "" {
+		return dao.ParsePriority(value)
+	}
+
+	if group.Priority != nil {
+		if priority := group.Priority.Of(method); priority != "" {
+			return priority, nil
+		}
+	}
+
+	return fallback, nil
+}
+
+// countHandled records that the job is about to be handled.
+func countHandled(job *Job) {
+	atomic.AddInt64(&priorityStats[job.Priority].handled, 1)
+	atomic.AddInt64(&priorityStats[job.Priority].waited, int64(time.Since(job.Queued)))
+}
+
+func writePriorityMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP broadcaster_jobs_handled_total Number of jobs taken out of the queues, per priority.")
+	fmt.Fprintln(w, "# TYPE broadcaster_jobs_handled_total counter")
+	for lane, p := range dao.Priorities {
+		fmt.Fprintf(w, "broadcaster_jobs_handled_total{priority=%s} %d\n", metricLabel(p), atomic.LoadInt64(&priorityStats[lane].handled))
+	}
+
+	fmt.Fprintln(w, "# HELP broadcaster_job_wait_seconds_total Time spent by the jobs in the queues, per priority.")
+	fmt.Fprintln(w, "# TYPE broadcaster_job_wait_seconds_total counter")
+	for lane, p := range dao.Priorities {
+		waited := time.Duration(atomic.LoadInt64(&priorityStats[lane].waited))
+		fmt.Fprintf(w, "broadcaster_job_wait_seconds_total{priority=%s} %g\n", metricLabel(p), waited.Seconds())
+	}
+}
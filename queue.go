@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+var (
+	errQueueFull  = errors.New("queue full")
+	errJobDropped = errors.New("dropped from a full queue")
+	errNoQueue    = errors.New("cache no longer configured")
+
+	// errQueueBlocked is returned by push when the job has to
+	// wait for room in the queue.
+	errQueueBlocked = errors.New("queue blocked")
+)
+
+// cacheQueue holds the jobs of a single cache, handled by workers
+// of its own so that a slow cache only holds back its own jobs.
+// Each priority has a lane of its own, the lanes of higher
+// priorities being emptied first.
+type cacheQueue struct {
+	lock     sync.RWMutex
+	name     string
+	address  string
+	settings dao.QueueSettings
+	lanes    []chan *Job
+	waits    []reflect.SelectCase
+	retired  bool
+	rejected int64
+	dropped  int64
+
+	// Number of jobs handled ahead of the ones waiting in each
+	// lane, guarded by pickLock.
+	pickLock sync.Mutex
+	passed   []int
+
+	// Closed once a job is taken out of the queue, if jobs wait
+	// for room, guarded by roomLock.
+	roomLock sync.Mutex
+	room     chan struct{}
+	waiting  bool
+}
+
+// queueStatus is the state of a queue as shown by the API.
+type queueStatus struct {
+	Name        string         `json:"name"`
+	Address     string         `json:"address"`
+	Depth       int            `json:"depth"`
+	Depths      map[string]int `json:"depths"`
+	Size        int            `json:"size"`
+	Concurrency int            `json:"concurrency"`
+	Full        string         `json:"full"`
+	Rejected    int64          `json:"rejected"`
+	Dropped     int64          `json:"dropped"`
+}
+
+var (
+	queuesLocker sync.Mutex
+	queues       = make(map[string]*cacheQueue)
+)
+
+func queueSettings(cache dao.Cache) dao.QueueSettings {
+	if cache.Queue != nil {
+		return *cache.Queue
+	}
+	return *dao.DefaultQueueSettings()
+}
+
+func newCacheQueue(cache dao.Cache) *cacheQueue {
+	q := &cacheQueue{
+		name:     cache.Name,
+		address:  cache.Address,
+		settings: queueSettings(cache),
+		room:     make(chan struct{}),
+	}
+	q.lanes = make([]chan *Job, len(dao.Priorities))
+	q.waits = make([]reflect.SelectCase, len(dao.Priorities))
+	q.passed = make([]int, len(dao.Priorities))
+	for lane := range q.lanes {
+		q.lanes[lane] = make(chan *Job, q.settings.Size)
+		q.waits[lane] = reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(q.lanes[lane]),
+		}
+	}
+
+	for i := 0; i < q.settings.Concurrency; i++ {
+		go jobWorker(q)
+	}
+
+	return q
+}
+
+// retire stops the queue from taking jobs, its workers leaving
+// once they handled the jobs already queued.
+func (q *cacheQueue) retire() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.retired = true
+	for _, lane := range q.lanes {
+		close(lane)
+	}
+	q.freed()
+}
+
+// roomSignal returns a channel closed once there may be room in
+// the queue.
+func (q *cacheQueue) roomSignal() <-chan struct{} {
+	q.roomLock.Lock()
+	defer q.roomLock.Unlock()
+
+	q.waiting = true
+	return q.room
+}
+
+// freed wakes up the jobs waiting for room in the queue.
+func (q *cacheQueue) freed() {
+	q.roomLock.Lock()
+	defer q.roomLock.Unlock()
+
+	if q.waiting {
+		close(q.room)
+		q.room = make(chan struct{})
+		q.waiting = false
+	}
+}
+
+// take returns the next job of the lane, if any.
+func take(lane chan *Job) *Job {
+	select {
+	case job := <-lane:
+		return job
+	default:
+		return nil
+	}
+}
+
+// pick returns the job of the highest priority waiting in the
+// queue, if any. A lane passed over more than the starvation limit
+// allows gets its turn regardless of the higher ones.
+func (q *cacheQueue) pick() *Job {
+	q.pickLock.Lock()
+	defer q.pickLock.Unlock()
+
+	for lane := len(q.lanes) - 1; lane > 0; lane-- {
+		if q.passed[lane] < q.settings.StarvationLimit {
+			continue
+		}
+		if job := take(q.lanes[lane]); job != nil {
+			q.passed[lane] = 0
+			return job
+		}
+	}
+
+	for lane := range q.lanes {
+		job := take(q.lanes[lane])
+		if job == nil {
+			continue
+		}
+
+		q.passed[lane] = 0
+		for lower := lane + 1; lower < len(q.lanes); lower++ {
+			if len(q.lanes[lower]) > 0 {
+				q.passed[lower]++
+			}
+		}
+		return job
+	}
+
+	return nil
+}
+
+// next waits for the next job to handle. It returns false once
+// the queue is retired and emptied.
+func (q *cacheQueue) next() (*Job, bool) {
+	job := q.pick()
+	if job == nil {
+		// Every lane is empty, the first job to come along
+		// is the one to handle, whatever its lane.
+		_, value, ok := reflect.Select(q.waits)
+		if ok {
+			job = value.Interface().(*Job)
+		} else if job = q.pick(); job == nil {
+			// The lanes are closed together, and drained.
+			return nil, false
+		}
+	}
+
+	q.freed()
+	return job, true
+}
+
+// setUpQueues creates the queue of each cache. Queues of caches
+// which are gone or whose settings changed are retired.
+func setUpQueues() {
+	var (
+		retired []*cacheQueue
+		seen    = make(map[string]bool)
+	)
+
+	locker.Lock()
+	caches := allCaches
+	locker.Unlock()
+
+	queuesLocker.Lock()
+	for _, cache := range caches {
+		// A cache found in several groups gets the
+		// settings of the first one.
+		if seen[cache.Address] {
+			continue
+		}
+		seen[cache.Address] = true
+
+		if q, found := queues[cache.Address]; found {
+			if q.settings == queueSettings(cache) {
+				continue
+			}
+			retired = append(retired, q)
+		}
+
+		queues[cache.Address] = newCacheQueue(cache)
+	}
+
+	for address, q := range queues {
+		if !seen[address] {
+			retired = append(retired, q)
+			delete(queues, address)
+		}
+	}
+	queuesLocker.Unlock()
+
+	for _, q := range retired {
+		q.retire()
+	}
+}
+
+// cacheQueueOf returns the queue of the cache, or nil if the cache
+// is no longer configured.
+func cacheQueueOf(cache dao.Cache) *cacheQueue {
+	queuesLocker.Lock()
+	defer queuesLocker.Unlock()
+
+	return queues[cache.Address]
+}
+
+// enqueue hands the job over to the queue of its cache. What
+// happens if the queue is full depends on its settings, jobs
+// which can't be queued are failed right away.
+func enqueue(job *Job) {
+	for {
+		q := cacheQueueOf(job.Cache)
+		if q == nil {
+			job.complete(http.StatusServiceUnavailable, errNoQueue)
+			return
+		}
+
+		// The lanes are only sent to while holding the lock, as
+		// retire closes them, but the lock is not held while
+		// waiting for room so that retire is not held back.
+		q.lock.RLock()
+		if q.retired {
+			q.lock.RUnlock()
+			continue
+		}
+
+		room := q.roomSignal()
+		err := q.push(job)
+		q.lock.RUnlock()
+
+		if err == errQueueBlocked {
+			select {
+			case <-room:
+				continue
+			case <-job.Ctx.Done():
+				err = job.Ctx.Err()
+			}
+		}
+
+		if err != nil {
+			job.complete(http.StatusServiceUnavailable, err)
+		}
+		return
+	}
+}
+
+// push adds the job to its lane. Once the lane is full, the job is
+// rejected, an older job is dropped, or errQueueBlocked is returned
+// for the job to wait for room.
+func (q *cacheQueue) push(job *Job) error {
+	var jobs = q.lanes[job.Priority]
+
+	job.Queued = time.Now()
+
+	select {
+	case jobs <- job:
+		return nil
+	default:
+	}
+
+	switch q.settings.Full {
+	case dao.QueueFullReject:
+		atomic.AddInt64(&q.rejected, 1)
+		return errQueueFull
+	case dao.QueueFullDropOldest:
+		for {
+			select {
+			case jobs <- job:
+				return nil
+			default:
+			}
+
+			select {
+			case old := <-jobs:
+				atomic.AddInt64(&q.dropped, 1)
+				old.complete(http.StatusServiceUnavailable, errJobDropped)
+			default:
+			}
+		}
+	}
+
+	return errQueueBlocked
+}
+
+func (q *cacheQueue) status() queueStatus {
+	var st = queueStatus{
+		Name:        q.name,
+		Address:     q.address,
+		Depths:      make(map[string]int, len(q.lanes)),
+		Size:        q.settings.Size,
+		Concurrency: q.settings.Concurrency,
+		Full:        q.settings.Full,
+		Rejected:    atomic.LoadInt64(&q.rejected),
+		Dropped:     atomic.LoadInt64(&q.dropped),
+	}
+
+	for lane, jobs := range q.lanes {
+		st.Depths[dao.Priorities[lane]] = len(jobs)
+		st.Depth += len(jobs)
+	}
+
+	return st
+}
+
+func queueStatuses() []queueStatus {
+	queuesLocker.Lock()
+	var statuses = make([]queueStatus, 0, len(queues))
+	for _, q := range queues {
+		statuses = append(statuses, q.status())
+	}
+	queuesLocker.Unlock()
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Address < statuses[j].Address
+	})
+
+	return statuses
+}
+
+// queuesHandler serves GET /queues, which returns the state of the
+// queue of each cache.
+func queuesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	out, _ := json.MarshalIndent(queueStatuses(), "", "  ")
+	w.Write(out)
+}
+
+func writeQueueMetrics(w io.Writer) {
+	var statuses = queueStatuses()
+
+	fmt.Fprintln(w, "# HELP broadcaster_queue_depth Number of jobs waiting in the queue of a cache, per priority.")
+	fmt.Fprintln(w, "# TYPE broadcaster_queue_depth gauge")
+	for _, st := range statuses {
+		for _, p := range dao.Priorities {
+			fmt.Fprintf(w, "broadcaster_queue_depth{cache=%s,address=%s,priority=%s} %d\n", metricLabel(st.Name), metricLabel(st.Address), metricLabel(p), st.Depths[p])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP broadcaster_queue_rejected_total Number of jobs rejected by the full queue of a cache.")
+	fmt.Fprintln(w, "# TYPE broadcaster_queue_rejected_total counter")
+	for _, st := range statuses {
+		fmt.Fprintf(w, "broadcaster_queue_rejected_total{cache=%s,address=%s} %d\n", metricLabel(st.Name), metricLabel(st.Address), st.Rejected)
+	}
+
+	fmt.Fprintln(w, "# HELP broadcaster_queue_dropped_total Number of jobs dropped from the full queue of a cache.")
+	fmt.Fprintln(w, "# TYPE broadcaster_queue_dropped_total counter")
+	for _, st := range statuses {
+		fmt.Fprintf(w, "broadcaster_queue_dropped_total{cache=%s,address=%s} %d\n", metricLabel(st.Name), metricLabel(st.Address), st.Dropped)
+	}
+}
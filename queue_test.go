@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+// idleQueue returns a queue without workers, its jobs left for the
+// test to take.
+func idleQueue(starvation int) *cacheQueue {
+	settings := dao.DefaultQueueSettings()
+	settings.Concurrency = 0
+	settings.StarvationLimit = starvation
+	return newCacheQueue(dao.Cache{Name: "Idle", Address: "idle:80", Queue: settings})
+}
+
+func queueJob(t *testing.T, q *cacheQueue, lane int) *Job {
+	t.Helper()
+
+	job := &Job{Ctx: context.Background(), Priority: lane}
+	if err := q.push(job); err != nil {
+		t.Fatalf("push to lane %d: %v", lane, err)
+	}
+	return job
+}
+
+func TestQueuePicksHigherLanesFirst(t *testing.T) {
+	q := idleQueue(100)
+	low := queueJob(t, q, 2)
+	normal := queueJob(t, q, 1)
+	high := queueJob(t, q, 0)
+
+	for i, want := range []*Job{high, normal, low} {
+		if got := q.pick(); got != want {
+			t.Fatalf("pick %d: got the job of lane %d", i, got.Priority)
+		}
+	}
+	if job := q.pick(); job != nil {
+		t.Fatalf("empty queue: got the job of lane %d", job.Priority)
+	}
+}
+
+func TestQueueStarvationLimit(t *testing.T) {
+	q := idleQueue(2)
+	for i := 0; i < 10; i++ {
+		queueJob(t, q, 0)
+	}
+	queueJob(t, q, 2)
+
+	var lanes []int
+	for i := 0; i < 4; i++ {
+		lanes = append(lanes, q.pick().Priority)
+	}
+
+	// The low job is passed over twice, then gets its turn.
+	want := []int{0, 0, 2, 0}
+	for i := range want {
+		if lanes[i] != want[i] {
+			t.Fatalf("picked lanes %v, want %v", lanes, want)
+		}
+	}
+	if q.passed[2] != 0 {
+		t.Errorf("passed count of the low lane: got %d, want 0", q.passed[2])
+	}
+}
+
+func TestQueueNextWakesOnEveryLane(t *testing.T) {
+	for lane := range dao.Priorities {
+		q := idleQueue(10)
+
+		got := make(chan *Job)
+		go func() {
+			job, _ := q.next()
+			got <- job
+		}()
+
+		// Give next the time to wait on the empty lanes.
+		time.Sleep(10 * time.Millisecond)
+		want := queueJob(t, q, lane)
+
+		select {
+		case job := <-got:
+			if job != want {
+				t.Errorf("lane %d: got another job", lane)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("lane %d: next never woke up", lane)
+		}
+	}
+}
+
+func TestQueueNextDrainsARetiredQueue(t *testing.T) {
+	q := idleQueue(10)
+	want := queueJob(t, q, 1)
+	q.retire()
+
+	if job, ok := q.next(); !ok || job != want {
+		t.Fatalf("got %v, %v, want the queued job", job, ok)
+	}
+	if job, ok := q.next(); ok {
+		t.Fatalf("got the job of lane %d from an emptied queue", job.Priority)
+	}
+}
+
+// fullQueue returns the queue of a cache, without workers, whose
+// normal lane is already full.
+func fullQueue(t *testing.T, full string) (*cacheQueue, *Job) {
+	settings := dao.DefaultQueueSettings()
+	settings.Size, settings.Concurrency, settings.Full = 1, 0, full
+
+	q := useQueue(t, dao.Cache{Name: "Full", Address: "full-" + full + ":80", Queue: settings})
+	return q, queueJob(t, q, 1)
+}
+
+// enqueuedJob hands a job over to the queue of the cache, as
+// dispatch does.
+func enqueuedJob(ctx context.Context, q *cacheQueue) *Job {
+	job := newJob(ctx, dao.Cache{Name: q.name, Address: q.address})
+	job.Priority = 1
+	pendingJobs.Add(1)
+	enqueue(job)
+	return job
+}
+
+func TestQueueFullReject(t *testing.T) {
+	q, queued := fullQueue(t, dao.QueueFullReject)
+
+	job := enqueuedJob(context.Background(), q)
+	if cr := waitJob(job); cr.Status != http.StatusServiceUnavailable || cr.Error != errQueueFull.Error() {
+		t.Errorf("got %+v, want the job rejected", cr)
+	}
+	if q.pick() != queued || q.status().Rejected != 1 {
+		t.Errorf("got the status %+v", q.status())
+	}
+}
+
+func TestQueueFullDropOldest(t *testing.T) {
+	q, queued := fullQueue(t, dao.QueueFullDropOldest)
+	pendingJobs.Add(1)
+	queued.Status, queued.Result = make(chan int, 1), make(chan []byte, 1)
+
+	job := enqueuedJob(context.Background(), q)
+	if q.pick() != job {
+		t.Error("the new job did not take the place of the oldest one")
+	}
+	job.complete(http.StatusOK, nil)
+	if <-queued.Status != http.StatusServiceUnavailable || string(<-queued.Result) != errJobDropped.Error() {
+		t.Error("the dropped job was not failed")
+	}
+	if q.status().Dropped != 1 {
+		t.Errorf("got the status %+v", q.status())
+	}
+}
+
+func TestQueueFullBlock(t *testing.T) {
+	q, queued := fullQueue(t, dao.QueueFullBlock)
+
+	enqueued := make(chan *Job)
+	go func() {
+		enqueued <- enqueuedJob(context.Background(), q)
+	}()
+
+	// The job waits for room without holding the lock of the
+	// queue, which can be taken meanwhile.
+	time.Sleep(20 * time.Millisecond)
+	q.lock.Lock()
+	q.lock.Unlock()
+
+	select {
+	case <-enqueued:
+		t.Fatal("the job did not wait for room in the queue")
+	default:
+	}
+
+	if job, _ := q.next(); job != queued {
+		t.Fatal("got another job than the queued one")
+	}
+
+	select {
+	case job := <-enqueued:
+		if q.pick() != job {
+			t.Error("the job is not in the queue once there was room")
+		}
+		job.complete(http.StatusOK, nil)
+	case <-time.After(time.Second):
+		t.Fatal("the job never got the room freed in the queue")
+	}
+}
+
+func TestQueueFullBlockGivesUp(t *testing.T) {
+	q, _ := fullQueue(t, dao.QueueFullBlock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	job := enqueuedJob(ctx, q)
+	if cr := waitJob(job); cr.Status != http.StatusGatewayTimeout && cr.Status != http.StatusServiceUnavailable {
+		t.Errorf("got %+v, want the job given up", cr)
+	}
+}
+
+func TestQueueOfARemovedCache(t *testing.T) {
+	job := newJob(context.Background(), dao.Cache{Name: "Removed", Address: "removed:80"})
+	pendingJobs.Add(1)
+	enqueue(job)
+
+	if cr := waitJob(job); cr.Status != http.StatusServiceUnavailable || cr.Error != errNoQueue.Error() {
+		t.Errorf("got %+v, want the job refused", cr)
+	}
+
+	queuesLocker.Lock()
+	_, found := queues["removed:80"]
+	queuesLocker.Unlock()
+	if found {
+		t.Error("a queue was created for a removed cache")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+// cacheResult is the outcome of a broadcast against a single cache.
+type cacheResult struct {
+	Host    string `json:"host,omitempty"`
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Status  int    `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+// failed reports whether the cache could not be reached or did
+// not answer with a status code counting as a success, a 2xx
+// unless the policy says otherwise.
+func (c cacheResult) failed(policy *dao.Policy) bool {
+	if c.Error != "" {
+		return true
+	}
+	if policy != nil {
+		return !policy.IsSuccess(c.Status)
+	}
+	return c.Status < 200 || c.Status > 299
+}
+
+// broadcastResult gathers the outcome of a broadcast against
+// every targeted cache along with the status code the broadcaster
+// answers with. Whether the policy of the group was met is only
+// known if it has one.
+type broadcastResult struct {
+	Status    int           `json:"status"`
+	PolicyMet *bool         `json:"policy_met,omitempty"`
+	Caches    []cacheResult `json:"caches"`
+	Stages    []stageResult `json:"stages,omitempty"`
+	Hosts     []hostResult  `json:"hosts,omitempty"`
+
+	policy *dao.Policy
+	// Outcome in each group of a broadcast routed to several.
+	parts []*broadcastResult
+}
+
+// applyPolicy sets the status code of the broadcast. Groups with
+// a policy answer with the status code it gives for the outcome.
+// Otherwise, if enforced, the status code is the first non-200
+// received in the configuration order rather than in the order
+// outcomes came in, so that it does not vary from a broadcast to
+// another. A failed stage fails the broadcast regardless.
+func (res *broadcastResult) applyPolicy() {
+	if res.policy == nil {
+		res.Status = http.StatusOK
+		for _, c := range res.Caches {
+			if *enforceStatus && res.Status == http.StatusOK {
+				res.Status = c.Status
+			}
+		}
+
+		for _, st := range res.Stages {
+			if !st.PolicyMet {
+				res.Status = st.Status
+				break
+			}
+		}
+		return
+	}
+
+	var successes int
+	for _, c := range res.Caches {
+		if !c.failed(res.policy) {
+			successes++
+		}
+	}
+
+	met := res.policy.IsMet(successes, len(res.Caches))
+	res.PolicyMet = &met
+
+	if met {
+		res.Status = res.policy.MetStatus
+	} else {
+		res.Status = res.policy.UnmetStatus
+	}
+}
+
+// combinedStatus returns the status code of a broadcast made of
+// several parts, such as one per host or per item, each judged on
+// its own. The policy, if any, is met only if it is met for every
+// part. Otherwise the status code is the one of the first part
+// which failed its own policy or, without one, got another status
+// code than a 200.
+func combinedStatus(parts []*broadcastResult, policy *dao.Policy) (int, *bool) {
+	var (
+		status    = http.StatusOK
+		failed    bool
+		allMet    = true
+		hasPolicy bool
+	)
+
+	for _, part := range parts {
+		partFailed := part.Status != http.StatusOK
+		if part.PolicyMet != nil {
+			hasPolicy = true
+			allMet = allMet && *part.PolicyMet
+			partFailed = !*part.PolicyMet
+		}
+
+		switch {
+		case partFailed && !failed:
+			status, failed = part.Status, true
+		case !failed && status == http.StatusOK:
+			status = part.Status
+		}
+	}
+
+	if policy != nil {
+		if allMet {
+			return policy.MetStatus, &allMet
+		}
+		return policy.UnmetStatus, &allMet
+	}
+	if hasPolicy {
+		return status, &allMet
+	}
+	return status, nil
+}
+
+// codes returns the status code received from each cache, keyed
+// by cache name. This is the body the broadcaster answers with.
+func (res *broadcastResult) codes() map[string]int {
+	var out = make(map[string]int, len(res.Caches))
+
+	for _, c := range res.Caches {
+		out[c.Name] = c.Status
+	}
+
+	return out
+}
+
+// failures returns the caches which failed.
+func (res *broadcastResult) failures() []cacheResult {
+	var out = []cacheResult{}
+
+	for _, c := range res.Caches {
+		if c.failed(res.policy) {
+			out = append(out, c)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+func TestCombinedStatus(t *testing.T) {
+	var (
+		met    = true
+		unmet  = false
+		policy = dao.DefaultPolicy()
+	)
+
+	tests := []struct {
+		name   string
+		parts  []*broadcastResult
+		policy *dao.Policy
+		status int
+		met    *bool
+	}{
+		{"no parts", nil, nil, http.StatusOK, nil},
+		{"all fine", []*broadcastResult{{Status: 200}, {Status: 200}}, nil, http.StatusOK, nil},
+		{"first failure wins", []*broadcastResult{{Status: 200}, {Status: 503}, {Status: 404}}, nil, 503, nil},
+		{"met for every part", []*broadcastResult{{Status: 200, PolicyMet: &met}, {Status: 200, PolicyMet: &met}}, policy, policy.MetStatus, &met},
+		{"groups of their own", []*broadcastResult{{Status: 204, PolicyMet: &met}, {Status: 200}}, nil, 204, &met},
+		{"unmet in a group", []*broadcastResult{{Status: 200}, {Status: 502, PolicyMet: &unmet}, {Status: 503}}, nil, 502, &unmet},
+		{"unmet for a part", []*broadcastResult{{Status: 200, PolicyMet: &met}, {Status: 502, PolicyMet: &unmet}}, policy, policy.UnmetStatus, &unmet},
+	}
+
+	for _, tt := range tests {
+		status, gotMet := combinedStatus(tt.parts, tt.policy)
+		if status != tt.status {
+			t.Errorf("%s: got a %d, want a %d", tt.name, status, tt.status)
+		}
+		if (gotMet == nil) != (tt.met == nil) || gotMet != nil && *gotMet != *tt.met {
+			t.Errorf("%s: got the policy met %v, want %v", tt.name, gotMet, tt.met)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+// retryPolicy returns the retry policy of the group the cache
+// belongs to, or the default one.
+func retryPolicy(cache dao.Cache) *dao.RetryPolicy {
+	if cache.Retry != nil {
+		return cache.Retry
+	}
+	return dao.DefaultRetryPolicy()
+}
+
+// errorClass tells what kind of error a request failed with.
+func errorClass(err error) string {
+	var (
+		netErr net.Error
+		dnsErr *net.DNSError
+		opErr  *net.OpError
+	)
+
+	switch {
+	case errors.As(err, &dnsErr):
+		return dao.ErrorDNS
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return dao.ErrorTimeout
+	case errors.As(err, &opErr),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNRESET):
+		return dao.ErrorConnection
+	}
+
+	return dao.ErrorOther
+}
+
+// retryAfter reads the Retry-After header of a response, given
+// either as a number of seconds or as a date.
+func retryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+
+	return 0
+}
+
+// retryDelay returns how long to wait before the given retry. A
+// delay asked for through Retry-After is honored if the policy
+// says so, without exceeding the maximum backoff.
+func retryDelay(policy *dao.RetryPolicy, retry int, header http.Header) time.Duration {
+	d := policy.Delay(retry, rand.Float64())
+
+	if policy.RetryAfter && header != nil {
+		if after := retryAfter(header); after > d {
+			d = after
+			if d > policy.MaxBackoff {
+				d = policy.MaxBackoff
+			}
+		}
+	}
+
+	return d
+}
+
+// sleep waits for d, unless ctx is done beforehand in which
+// case it returns false.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
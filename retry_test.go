@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&net.DNSError{Err: "no such host", Name: "cache"}, dao.ErrorDNS},
+		{fmt.Errorf("dial: %w", &net.DNSError{Err: "no such host"}), dao.ErrorDNS},
+		{timeoutError{}, dao.ErrorTimeout},
+		{context.DeadlineExceeded, dao.ErrorTimeout},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, dao.ErrorConnection},
+		{fmt.Errorf("read: %w", syscall.ECONNRESET), dao.ErrorConnection},
+		{io.EOF, dao.ErrorConnection},
+		{io.ErrUnexpectedEOF, dao.ErrorConnection},
+		{errors.New("boom"), dao.ErrorOther},
+	}
+
+	for _, tt := range tests {
+		if got := errorClass(tt.err); got != tt.want {
+			t.Errorf("errorClass(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetryDelayHonorsRetryAfter(t *testing.T) {
+	policy := &dao.RetryPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: 5 * time.Second, RetryAfter: true}
+
+	header := func(value string) http.Header {
+		h := make(http.Header)
+		h.Set("Retry-After", value)
+		return h
+	}
+
+	tests := []struct {
+		name     string
+		header   http.Header
+		min, max time.Duration
+	}{
+		{"no header", nil, 100 * time.Millisecond, 100 * time.Millisecond},
+		{"seconds", header("2"), 2 * time.Second, 2 * time.Second},
+		{"clamped", header("60"), 5 * time.Second, 5 * time.Second},
+		{"shorter than the backoff", header("0"), 100 * time.Millisecond, 100 * time.Millisecond},
+		{"date", header(time.Now().Add(3 * time.Second).UTC().Format(http.TimeFormat)), 1 * time.Second, 3 * time.Second},
+		{"past date", header(time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)), 100 * time.Millisecond, 100 * time.Millisecond},
+		{"garbage", header("soon"), 100 * time.Millisecond, 100 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		if d := retryDelay(policy, 0, tt.header); d < tt.min || d > tt.max {
+			t.Errorf("%s: retryDelay = %s, want within [%s, %s]", tt.name, d, tt.min, tt.max)
+		}
+	}
+
+	policy.RetryAfter = false
+	if d := retryDelay(policy, 0, header("2")); d != 100*time.Millisecond {
+		t.Errorf("Retry-After honored against the policy: %s", d)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+// hostRoutes maps each host name, or wildcard, to the groups
+// serving it, as declared by their [group.hosts] sections.
+var hostRoutes = make(map[string][]string)
+
+// buildHostRoutes maps the host names of the groups to them, the
+// groups of a host sorted by name.
+func buildHostRoutes(groups map[string]dao.Group) map[string][]string {
+	var routes = make(map[string][]string)
+
+	for name, g := range groups {
+		for _, host := range g.Hosts {
+			routes[host] = append(routes[host], name)
+		}
+	}
+
+	for host := range routes {
+		sort.Strings(routes[host])
+	}
+	return routes
+}
+
+// hostGroups returns the names of the groups serving the host. An
+// exact name wins over the wildcards, the most specific wildcard
+// over the others.
+func hostGroups(host string) []string {
+	host = dao.NormalizeHost(host)
+
+	locker.Lock()
+	defer locker.Unlock()
+
+	if names, found := hostRoutes[host]; found {
+		return names
+	}
+
+	for suffix := host; ; {
+		i := strings.Index(suffix, ".")
+		if i == -1 {
+			return nil
+		}
+
+		suffix = suffix[i+1:]
+		if names, found := hostRoutes["*."+suffix]; found {
+			return names
+		}
+	}
+}
+
+// groupRoute is a group a request is broadcasted to, along with
+// the hosts it is sent for there when X-Hosts lists some.
+type groupRoute struct {
+	name  string
+	group dao.Group
+	hosts []string
+}
+
+// requestRoutes returns the groups a request is broadcasted to, the
+// one named by its X-Group header or else the groups serving its
+// hosts. Each group is only sent the hosts it serves, with its own
+// settings.
+func requestRoutes(r *http.Request) ([]groupRoute, error) {
+	var hosts = requestHosts(r)
+
+	if name := r.Header.Get("X-Group"); name != "" {
+		group, err := targetGroup(name)
+		if err != nil {
+			return nil, err
+		}
+		return []groupRoute{{name: name, group: group, hosts: hosts}}, nil
+	}
+
+	if len(hosts) == 0 {
+		names, err := routeHost(r.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		var routes []groupRoute
+		for _, name := range names {
+			group, err := targetGroup(name)
+			if err != nil {
+				return nil, err
+			}
+			routes = append(routes, groupRoute{name: name, group: group})
+		}
+		return dedupedRoutes(routes), nil
+	}
+
+	var routes []groupRoute
+	for _, host := range hosts {
+		names, err := routeHost(host)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range names {
+			i := routeIndex(routes, name)
+			if i == -1 {
+				group, err := targetGroup(name)
+				if err != nil {
+					return nil, err
+				}
+				routes = append(routes, groupRoute{name: name, group: group})
+				i = len(routes) - 1
+			}
+			routes[i].hosts = append(routes[i].hosts, host)
+		}
+	}
+	return dedupedRoutes(routes), nil
+}
+
+// dedupedRoutes drops, out of each route, the caches an earlier
+// route already sends the request to for every host of the route,
+// so that a cache found in several of the groups gets the request
+// once, along with the first of them. Routes whose caches are all
+// sent the request already are dropped.
+func dedupedRoutes(routes []groupRoute) []groupRoute {
+	var (
+		out  = routes[:0]
+		sent = make(map[string]map[string]bool)
+	)
+
+	for _, route := range routes {
+		var (
+			hosts  = route.hosts
+			caches []dao.Cache
+		)
+		if len(hosts) == 0 {
+			hosts = []string{""}
+		}
+
+		for _, cache := range route.group.Caches {
+			if sent[cache.Address] == nil {
+				sent[cache.Address] = make(map[string]bool)
+			}
+
+			var covered = true
+			for _, host := range hosts {
+				covered = covered && sent[cache.Address][host]
+				sent[cache.Address][host] = true
+			}
+			if !covered {
+				caches = append(caches, cache)
+			}
+		}
+
+		if len(caches) == 0 && len(route.group.Caches) > 0 {
+			continue
+		}
+		if len(caches) < len(route.group.Caches) {
+			route.group = groupOf(route.group, caches)
+		}
+		out = append(out, route)
+	}
+
+	return out
+}
+
+// groupOf returns the group restricted to some of its caches, and
+// its stages to those caches.
+func groupOf(group dao.Group, caches []dao.Cache) dao.Group {
+	var kept = make(map[string]bool, len(caches))
+	for _, cache := range caches {
+		kept[cache.Name] = true
+	}
+
+	var stages []dao.Stage
+	for _, stage := range group.Stages {
+		var names []string
+		for _, name := range stage.Caches {
+			if kept[name] {
+				names = append(names, name)
+			}
+		}
+		if len(names) > 0 {
+			stages = append(stages, dao.Stage{Name: stage.Name, Caches: names})
+		}
+	}
+
+	group.Caches, group.Stages = caches, stages
+	return group
+}
+
+// routeHost returns the names of the groups serving the host.
+// Hosts no group serves go where -unmatched-host says, the empty
+// name standing for every cache.
+func routeHost(host string) ([]string, error) {
+	if names := hostGroups(host); len(names) > 0 {
+		return names, nil
+	}
+
+	switch *unmatchedHost {
+	case "all":
+		return []string{""}, nil
+	case "reject":
+		return nil, fmt.Errorf("No group serves %s, X-Group is required.", dao.NormalizeHost(host))
+	}
+	return []string{*unmatchedHost}, nil
+}
+
+func routeIndex(routes []groupRoute, name string) int {
+	for i, route := range routes {
+		if route.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// routesName names the groups of the routes, for the logs and the
+// reports of the broadcast.
+func routesName(routes []groupRoute) string {
+	var names = make([]string, len(routes))
+	for i, route := range routes {
+		names[i] = route.name
+	}
+	return strings.Join(names, ",")
+}
+
+// routesCaches returns the number of caches of the routes, a cache
+// found in several of them being counted once.
+func routesCaches(routes []groupRoute) int {
+	var groups = make([]dao.Group, len(routes))
+	for i, route := range routes {
+		groups[i] = route.group
+	}
+	return countCaches(groups)
+}
+
+// countCaches returns the number of distinct caches of the groups.
+func countCaches(groups []dao.Group) int {
+	var seen = make(map[string]bool)
+	for _, group := range groups {
+		for _, cache := range group.Caches {
+			seen[cache.Address] = true
+		}
+	}
+	return len(seen)
+}
+
+// routeRequests returns the request broadcasted to the group of
+// each route. A request routed to several groups is sent to each
+// of them for the hosts it serves.
+func routeRequests(r *http.Request, routes []groupRoute, body *requestBody) ([]broadcastRequest, error) {
+	var reqs = make([]broadcastRequest, len(routes))
+
+	for i, route := range routes {
+		br, err := groupRequest(r, route.group, body)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(routes) > 1 && len(route.hosts) > 0 {
+			br.Host, br.Hosts = route.hosts[0], route.hosts
+		}
+		reqs[i] = br
+	}
+
+	return reqs, nil
+}
+
+// broadcastRoutes broadcasts the request of each route to its
+// group, at the same time. Each group judges its outcome against
+// its own policy, the broadcast failing if any of them fails.
+func broadcastRoutes(ctx context.Context, routes []groupRoute, reqs []broadcastRequest, progress func(cacheResult)) *broadcastResult {
+	if len(routes) == 1 {
+		return broadcast(ctx, reqs[0], routes[0].group, progress)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		results = make([]*broadcastResult, len(routes))
+	)
+
+	for i, route := range routes {
+		wg.Add(1)
+		go func(i int, group dao.Group) {
+			defer wg.Done()
+			results[i] = broadcast(ctx, reqs[i], group, progress)
+		}(i, route.group)
+	}
+
+	wg.Wait()
+
+	return combinedRoutes(results)
+}
+
+// combinedRoutes gathers the outcome of a broadcast in each of the
+// groups it was routed to.
+func combinedRoutes(parts []*broadcastResult) *broadcastResult {
+	var res = &broadcastResult{parts: parts}
+
+	for _, part := range parts {
+		res.Caches = append(res.Caches, part.Caches...)
+		res.Stages = append(res.Stages, part.Stages...)
+		res.Hosts = append(res.Hosts, part.Hosts...)
+	}
+
+	res.Status, res.PolicyMet = combinedStatus(parts, nil)
+	return res
+}
+
+// unfinishedRoutes is the outcome of a broadcast left before it
+// completed, every cache of the routes being reported as not
+// having answered in time.
+func unfinishedRoutes(ctx context.Context, routes []groupRoute) *broadcastResult {
+	var parts = make([]*broadcastResult, len(routes))
+
+	for i, route := range routes {
+		part := &broadcastResult{policy: route.group.Policy}
+		for _, cache := range route.group.Caches {
+			part.Caches = append(part.Caches, unfinishedResult(ctx, cache))
+		}
+		part.applyPolicy()
+		parts[i] = part
+	}
+
+	if len(parts) == 1 {
+		return parts[0]
+	}
+	return combinedRoutes(parts)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+// useGroups configures the groups for the test, along with the
+// hosts they serve.
+func useGroups(t *testing.T, configured ...dao.Group) {
+	t.Helper()
+
+	locker.Lock()
+	saved, savedRoutes := groups, hostRoutes
+	groups = make(map[string]dao.Group)
+	for _, g := range configured {
+		groups[g.Name] = g
+	}
+	hostRoutes = buildHostRoutes(groups)
+	locker.Unlock()
+
+	t.Cleanup(func() {
+		locker.Lock()
+		groups, hostRoutes = saved, savedRoutes
+		locker.Unlock()
+	})
+}
+
+// hostRecorder is a cache recording the hosts it is sent.
+type hostRecorder struct {
+	lock  sync.Mutex
+	hosts []string
+}
+
+func (hr *hostRecorder) cache(t *testing.T, status int) dao.Cache {
+	return testCache(t, func(w http.ResponseWriter, r *http.Request) {
+		hr.lock.Lock()
+		hr.hosts = append(hr.hosts, r.Host)
+		hr.lock.Unlock()
+		w.WriteHeader(status)
+	})
+}
+
+func (hr *hostRecorder) received() string {
+	hr.lock.Lock()
+	defer hr.lock.Unlock()
+
+	return strings.Join(hr.hosts, ",")
+}
+
+func TestRequestRoutes(t *testing.T) {
+	useGroups(t,
+		dao.Group{Name: "prod", Hosts: []string{"www.example.com", "*.example.com"}},
+		dao.Group{Name: "shop", Hosts: []string{"shop.example.com"}},
+		dao.Group{Name: "eu", Hosts: []string{"www.example.eu"}},
+	)
+
+	tests := []struct {
+		group, host, hosts string
+		want               string
+	}{
+		{"", "www.example.com", "", "prod"},
+		{"", "shop.example.com", "", "shop"},
+		{"", "m.example.com", "", "prod"},
+		{"eu", "www.example.com", "", "eu"},
+		{"", "ignored", "www.example.com, www.example.eu, m.example.com", "prod:www.example.com+m.example.com eu:www.example.eu"},
+		{"", "ignored", "shop.example.com, www.example.com", "shop:shop.example.com prod:www.example.com"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("PURGE", "/", nil)
+		r.Host = tt.host
+		if tt.group != "" {
+			r.Header.Set("X-Group", tt.group)
+		}
+		if tt.hosts != "" {
+			r.Header.Set("X-Hosts", tt.hosts)
+		}
+
+		routes, err := requestRoutes(r)
+		if err != nil {
+			t.Fatalf("%+v: %v", tt, err)
+		}
+
+		var got []string
+		for _, route := range routes {
+			if route.hosts == nil || tt.group != "" {
+				got = append(got, route.name)
+			} else {
+				got = append(got, route.name+":"+strings.Join(route.hosts, "+"))
+			}
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("%+v: got the routes %v, want %s", tt, got, tt.want)
+		}
+	}
+}
+
+func TestRequestRoutesUnmatchedHost(t *testing.T) {
+	useGroups(t, dao.Group{Name: "prod", Hosts: []string{"www.example.com"}})
+
+	saved := *unmatchedHost
+	defer func() { *unmatchedHost = saved }()
+
+	r := httptest.NewRequest("PURGE", "/", nil)
+	r.Host = "unknown.example.org"
+
+	*unmatchedHost = "reject"
+	if _, err := requestRoutes(r); err == nil {
+		t.Error("reject: no error")
+	}
+
+	*unmatchedHost = "prod"
+	if routes, err := requestRoutes(r); err != nil || len(routes) != 1 || routes[0].name != "prod" {
+		t.Errorf("fallback: got %v, %v", routes, err)
+	}
+
+	*unmatchedHost = "all"
+	if routes, err := requestRoutes(r); err != nil || len(routes) != 1 || routes[0].name != "" {
+		t.Errorf("all: got %v, %v", routes, err)
+	}
+}
+
+func TestBroadcastRoutedPerHost(t *testing.T) {
+	var prodCache, euCache hostRecorder
+
+	useGroups(t,
+		dao.Group{Name: "prod", Hosts: []string{"www.example.com"}, Caches: []dao.Cache{prodCache.cache(t, http.StatusOK)}},
+		dao.Group{Name: "eu", Hosts: []string{"www.example.eu"}, Caches: []dao.Cache{euCache.cache(t, http.StatusNotFound)}, Policy: &dao.Policy{Require: dao.RequireAll, MetStatus: 200, UnmetStatus: 502}},
+	)
+
+	r := httptest.NewRequest("PURGE", "/page", nil)
+	r.Header.Set("X-Hosts", "www.example.com, www.example.eu")
+	w := httptest.NewRecorder()
+	reqHandler(w, r)
+
+	if got := prodCache.received(); got != "www.example.com" {
+		t.Errorf("prod received %q, want www.example.com", got)
+	}
+	if got := euCache.received(); got != "www.example.eu" {
+		t.Errorf("eu received %q, want www.example.eu", got)
+	}
+
+	// The policy of eu isn't met, the broadcast fails with the
+	// status code it gives.
+	if w.Code != 502 {
+		t.Errorf("got a %d, want a 502", w.Code)
+	}
+	if got := w.Header().Get("X-Policy-Met"); got != "false" {
+		t.Errorf("X-Policy-Met: got %q, want false", got)
+	}
+
+	var codes map[string]map[string]int
+	if err := json.Unmarshal(w.Body.Bytes(), &codes); err != nil {
+		t.Fatal(err)
+	}
+	if len(codes["www.example.com"]) != 1 || len(codes["www.example.eu"]) != 1 {
+		t.Errorf("got the codes %v", codes)
+	}
+}
+
+func TestBulkRoutedPerItemHost(t *testing.T) {
+	var prodCache, euCache hostRecorder
+
+	useGroups(t,
+		dao.Group{Name: "prod", Hosts: []string{"www.example.com"}, Caches: []dao.Cache{prodCache.cache(t, http.StatusOK)}},
+		dao.Group{Name: "eu", Hosts: []string{"www.example.eu"}, Caches: []dao.Cache{euCache.cache(t, http.StatusOK)}},
+	)
+
+	body := `[{"path": "/a", "host": "www.example.eu"}, "/b", {"path": "/c", "hosts": ["www.example.com", "www.example.eu"]}]`
+	r := httptest.NewRequest(http.MethodPost, "/bulk", strings.NewReader(body))
+	r.Host = "www.example.com"
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	bulkHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got a %d: %s", w.Code, w.Body)
+	}
+	if got := prodCache.received(); got != "www.example.com,www.example.com" {
+		t.Errorf("prod received %q, want www.example.com twice", got)
+	}
+	if got := euCache.received(); got != "www.example.eu,www.example.eu" {
+		t.Errorf("eu received %q, want www.example.eu twice", got)
+	}
+
+	var res bulkResult
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"eu /a", "prod /b", "prod /c", "eu /c"}
+	if len(res.Items) != len(want) {
+		t.Fatalf("got %d items, want %d", len(res.Items), len(want))
+	}
+	for i, item := range res.Items {
+		if got := item.Group + " " + item.Path; got != want[i] {
+			t.Errorf("item %d: got %s, want %s", i, got, want[i])
+		}
+	}
+}
+
+func TestDedupedRoutes(t *testing.T) {
+	var (
+		c1 = dao.Cache{Name: "Cache1", Address: "http://cache1"}
+		c2 = dao.Cache{Name: "Cache2", Address: "http://cache2"}
+		c3 = dao.Cache{Name: "Cache3", Address: "http://cache3"}
+	)
+
+	prod := dao.Group{Name: "prod", Caches: []dao.Cache{c1, c2}}
+	eu := dao.Group{Name: "eu", Caches: []dao.Cache{c2, c3}, Stages: []dao.Stage{{Name: "shields", Caches: []string{"Cache2"}}, {Name: "edges", Caches: []string{"Cache3"}}}}
+	mirror := dao.Group{Name: "mirror", Caches: []dao.Cache{c1}}
+
+	routes := dedupedRoutes([]groupRoute{{name: "prod", group: prod}, {name: "eu", group: eu}, {name: "mirror", group: mirror}})
+	if len(routes) != 2 || routes[1].name != "eu" {
+		t.Fatalf("got the routes %q", routesName(routes))
+	}
+	if got := routes[1].group; len(got.Caches) != 1 || got.Caches[0].Name != c3.Name || len(got.Stages) != 1 || got.Stages[0].Name != "edges" {
+		t.Errorf("eu: got the caches %v and the stages %v", got.Caches, got.Stages)
+	}
+	if len(eu.Caches) != 2 {
+		t.Error("the configured group was changed")
+	}
+
+	// A cache is sent the hosts an earlier route did not send it.
+	routes = dedupedRoutes([]groupRoute{
+		{name: "prod", group: prod, hosts: []string{"www.example.com"}},
+		{name: "eu", group: eu, hosts: []string{"www.example.com", "www.example.eu"}},
+		{name: "mirror", group: mirror, hosts: []string{"www.example.com"}},
+	})
+	if len(routes) != 2 || len(routes[1].group.Caches) != 2 {
+		t.Errorf("got the routes %q, want eu with all of its caches", routesName(routes))
+	}
+}
+
+func TestSharedCacheBroadcastedOnce(t *testing.T) {
+	var shared, prodOnly, euOnly hostRecorder
+
+	sharedCache := shared.cache(t, http.StatusOK)
+	useGroups(t,
+		dao.Group{Name: "prod", Hosts: []string{"www.example.com"}, Caches: []dao.Cache{prodOnly.cache(t, http.StatusOK), sharedCache}},
+		dao.Group{Name: "eu", Hosts: []string{"www.example.com"}, Caches: []dao.Cache{sharedCache, euOnly.cache(t, http.StatusOK)}},
+	)
+
+	r := httptest.NewRequest("PURGE", "http://www.example.com/page", nil)
+	w := httptest.NewRecorder()
+	reqHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got a %d: %s", w.Code, w.Body.String())
+	}
+	if got := shared.received(); got != "www.example.com" {
+		t.Errorf("the shared cache received %q, want the request once", got)
+	}
+	if prodOnly.received() == "" || euOnly.received() == "" {
+		t.Error("a cache of a single group was left out")
+	}
+
+	var codes map[string]int
+	if err := json.Unmarshal(w.Body.Bytes(), &codes); err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != 3 || codes[sharedCache.Name] != http.StatusOK {
+		t.Errorf("got the codes %v", codes)
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scheduleHeaders only matter when submitting a scheduled broadcast
+// and are not kept along with it.
+var scheduleHeaders = []string{"X-Schedule-At", "X-Delay", "X-Async", "X-Confirm", "X-Guard-Token"}
+
+// scheduledBroadcast is a broadcast waiting to be run at a given
+// time, requested with the X-Schedule-At or X-Delay header. Once
+// due it is run as an asynchronous broadcast of the same id.
+type scheduledBroadcast struct {
+	ID      string      `json:"id"`
+	Method  string      `json:"method"`
+	Path    string      `json:"path"`
+	Query   string      `json:"query,omitempty"`
+	Host    string      `json:"host"`
+	Group   string      `json:"group,omitempty"`
+	Headers http.Header `json:"headers"`
+	Body    []byte      `json:"body,omitempty"`
+	At      time.Time   `json:"at"`
+	Created time.Time   `json:"created"`
+	// Who submitted the broadcast, for the audit log, as the
+	// credentials and connection are gone once it runs.
+	Identity string `json:"identity,omitempty"`
+	IP       string `json:"ip,omitempty"`
+
+	timer clockTimer
+}
+
+var (
+	schedulesLocker  sync.Mutex
+	schedules        = make(map[string]*scheduledBroadcast)
+	schedulesStopped bool
+
+	schedulerClock clock = realClock{}
+)
+
+// request rebuilds the request the broadcast was submitted with,
+// on behalf of the client which submitted it.
+func (sb *scheduledBroadcast) request() *http.Request {
+	r := &http.Request{
+		Method:     sb.Method,
+		URL:        &url.URL{Path: sb.Path, RawQuery: sb.Query},
+		Host:       sb.Host,
+		Header:     sb.Headers.Clone(),
+		RemoteAddr: sb.IP,
+	}
+
+	if r.Header == nil {
+		r.Header = make(http.Header)
+	}
+	if sb.Identity != "" {
+		r.Header.Set("X-Client-Id", sb.Identity)
+	}
+	return r
+}
+
+// parseScheduleTime reads a point in time given either in the
+// RFC 3339 format or as a unix timestamp.
+func parseScheduleTime(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+
+	at, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid time %q, expected an RFC 3339 time or a unix timestamp.", value)
+	}
+	return at.UTC(), nil
+}
+
+// scheduledAt returns when the request asks to be broadcasted,
+// either at a given time through the X-Schedule-At header or after
+// a delay through the X-Delay one. The zero time is returned if
+// the request is to be broadcasted right away.
+func scheduledAt(r *http.Request) (time.Time, error) {
+	var (
+		at    = r.Header.Get("X-Schedule-At")
+		delay = r.Header.Get("X-Delay")
+	)
+
+	switch {
+	case at != "" && delay != "":
+		return time.Time{}, errors.New("X-Schedule-At and X-Delay can't be given together.")
+	case at != "":
+		return parseScheduleTime(at)
+	case delay != "":
+		d, ok := parseDuration(delay)
+		if !ok {
+			return time.Time{}, fmt.Errorf("Invalid X-Delay %q, expected a duration such as 10m or a number of seconds.", delay)
+		}
+		return schedulerClock.Now().Add(d).UTC(), nil
+	}
+
+	return time.Time{}, nil
+}
+
+func scheduleFilePath() string {
+	if *scheduleFile != "" {
+		return *scheduleFile
+	}
+	return filepath.Join(filepath.Dir(*cachesCfgFile), "scheduled.json")
+}
+
+// saveSchedules writes the pending broadcasts to disk, so that
+// they survive a restart. The caller must hold schedulesLocker.
+func saveSchedules() error {
+	var path = scheduleFilePath()
+
+	out, err := json.MarshalIndent(sortedSchedules(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Replacing the file at once keeps it whole if the
+	// broadcaster stops halfway. Callback urls may carry tokens,
+	// the file is only readable by the broadcaster.
+	if err = ioutil.WriteFile(path+".tmp", out, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// loadSchedules reads the pending broadcasts back from disk. Those
+// which became due in the meantime are run right away.
+func loadSchedules() error {
+	content, err := ioutil.ReadFile(scheduleFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var loaded []*scheduledBroadcast
+	if err = json.Unmarshal(content, &loaded); err != nil {
+		return fmt.Errorf("%s: %s", scheduleFilePath(), err.Error())
+	}
+
+	schedulesLocker.Lock()
+	defer schedulesLocker.Unlock()
+
+	for _, sb := range loaded {
+		schedules[sb.ID] = sb
+		armSchedule(sb)
+	}
+
+	if len(loaded) > 0 {
+		fmt.Fprintf(os.Stdout, "Loaded %d scheduled broadcasts.\n", len(loaded))
+	}
+
+	return nil
+}
+
+// sortedSchedules returns the pending broadcasts, the earliest
+// first. The caller must hold schedulesLocker.
+func sortedSchedules() []*scheduledBroadcast {
+	var list = make([]*scheduledBroadcast, 0, len(schedules))
+	for _, sb := range schedules {
+		list = append(list, sb)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].At.Before(list[j].At)
+	})
+
+	return list
+}
+
+// armSchedule sets the timer running the broadcast once due. The
+// caller must hold schedulesLocker.
+func armSchedule(sb *scheduledBroadcast) {
+	sb.timer = schedulerClock.AfterFunc(sb.At.Sub(schedulerClock.Now()), func() {
+		runSchedule(sb)
+	})
+}
+
+// scheduleBroadcast registers the request to be broadcasted at
+// the given time.
+func scheduleBroadcast(id string, r *http.Request, groupName string, at time.Time, body *requestBody) (*scheduledBroadcast, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = body.bytes(); err != nil {
+			return nil, err
+		}
+	}
+
+	sb := &scheduledBroadcast{
+		ID:      id,
+		Method:  r.Method,
+		Path:    r.URL.Path,
+		Query:   r.URL.RawQuery,
+		Host:    r.Host,
+		Group:   groupName,
+		Headers: r.Header.Clone(),
+		Body:    data,
+		At:      at,
+		Created: schedulerClock.Now().UTC(),
+
+		Identity: clientIdentity(r),
+		IP:       clientIP(r),
+	}
+
+	for _, h := range append(scheduleHeaders, credentialHeaders...) {
+		sb.Headers.Del(h)
+	}
+
+	schedulesLocker.Lock()
+	defer schedulesLocker.Unlock()
+
+	schedules[sb.ID] = sb
+	if err := saveSchedules(); err != nil {
+		delete(schedules, sb.ID)
+		return nil, err
+	}
+
+	armSchedule(sb)
+	sendToLogChannel("Scheduled ", sb.Method, " ", sb.Path, " at ", sb.At.Format(time.RFC3339), ".\n")
+
+	return sb, nil
+}
+
+// runSchedule starts the broadcast, unless it has been canceled
+// or rescheduled in the meantime.
+func runSchedule(sb *scheduledBroadcast) {
+	schedulesLocker.Lock()
+	if current, found := schedules[sb.ID]; !found || current != sb || schedulesStopped {
+		schedulesLocker.Unlock()
+		return
+	}
+
+	delete(schedules, sb.ID)
+	if err := saveSchedules(); err != nil {
+		sendToLogChannel("Saving the scheduled broadcasts failed: ", err.Error(), "\n")
+	}
+	schedulesLocker.Unlock()
+
+	r := sb.request()
+
+	// The configuration may have been reloaded since.
+	routes, err := requestRoutes(r)
+	if err != nil {
+		sendToLogChannel("Scheduled broadcast ", sb.ID, " dropped: ", err.Error(), "\n")
+		return
+	}
+
+	run, err := prepareBroadcast(sb.ID, r, routes, newMemoryBody(sb.Body, r.Header.Get("Content-Type")))
+	if err != nil {
+		sendToLogChannel("Scheduled broadcast ", sb.ID, " dropped: ", err.Error(), "\n")
+		return
+	}
+
+	// The allowed callback hosts may have changed too.
+	hooks, err := webhookUrls(r)
+	if err != nil {
+		sendToLogChannel("Scheduled broadcast ", sb.ID, ": ", err.Error(), " Only the webhooks are notified.\n")
+		hooks = splitUrls(*webhooks)
+	}
+
+	startAsyncBroadcast(sb.ID, r, routesName(routes), hooks, func() *broadcastResult {
+		return run(context.Background(), nil)
+	})
+}
+
+// stopSchedules keeps the pending broadcasts from running, they
+// stay on disk for the next start.
+func stopSchedules() {
+	schedulesLocker.Lock()
+	defer schedulesLocker.Unlock()
+
+	schedulesStopped = true
+	for _, sb := range schedules {
+		sb.timer.Stop()
+	}
+}
+
+// schedulesHandler serves GET /schedules, which lists the pending
+// broadcasts, the earliest first.
+func schedulesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	schedulesLocker.Lock()
+	out, _ := json.MarshalIndent(sortedSchedules(), "", "  ")
+	schedulesLocker.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+// rescheduleRequest is the body of a PUT /schedules/{id}, giving
+// either the new time or the delay from now.
+type rescheduleRequest struct {
+	At    string `json:"at"`
+	Delay string `json:"delay"`
+}
+
+func (rr rescheduleRequest) time() (time.Time, error) {
+	switch {
+	case rr.At != "" && rr.Delay != "":
+		return time.Time{}, errors.New("at and delay can't be given together.")
+	case rr.At != "":
+		return parseScheduleTime(rr.At)
+	case rr.Delay != "":
+		d, ok := parseDuration(rr.Delay)
+		if !ok {
+			return time.Time{}, fmt.Errorf("Invalid delay %q, expected a duration such as 10m or a number of seconds.", rr.Delay)
+		}
+		return schedulerClock.Now().Add(d).UTC(), nil
+	}
+
+	return time.Time{}, errors.New("Either at or delay must be given.")
+}
+
+// scheduleHandler serves /schedules/{id}: GET returns the pending
+// broadcast, DELETE cancels it and PUT reschedules it.
+func scheduleHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		id  = strings.TrimPrefix(r.URL.Path, "/schedules/")
+		at  time.Time
+		err error
+	)
+
+	switch r.Method {
+	case http.MethodGet, http.MethodDelete:
+	case http.MethodPut:
+		var rr rescheduleRequest
+
+		body, _ := ioutil.ReadAll(io.LimitReader(r.Body, 1<<16))
+		if err = json.Unmarshal(body, &rr); err != nil {
+			http.Error(w, "Invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if at, err = rr.time(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	schedulesLocker.Lock()
+	defer schedulesLocker.Unlock()
+
+	sb, found := schedules[id]
+	if !found {
+		http.Error(w, "Scheduled broadcast "+id+" not found.", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+		sb.timer.Stop()
+		delete(schedules, id)
+		sendToLogChannel("Scheduled broadcast ", id, " canceled.\n")
+	case http.MethodPut:
+		sb.timer.Stop()
+
+		// The timer may be firing already, the copy tells it
+		// apart from the rescheduled broadcast.
+		updated := *sb
+		updated.At = at
+		schedules[id] = &updated
+		armSchedule(&updated)
+
+		sb = &updated
+		sendToLogChannel("Scheduled broadcast ", id, " moved to ", at.Format(time.RFC3339), ".\n")
+	}
+
+	if r.Method != http.MethodGet {
+		if err = saveSchedules(); err != nil {
+			sendToLogChannel("Saving the scheduled broadcasts failed: ", err.Error(), "\n")
+		}
+	}
+
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	out, _ := json.MarshalIndent(sb, "", "  ")
+	w.Write(out)
+}
+
+func writeScheduleMetrics(w io.Writer) {
+	schedulesLocker.Lock()
+	pending := len(schedules)
+	schedulesLocker.Unlock()
+
+	fmt.Fprintln(w, "# HELP broadcaster_scheduled_broadcasts Number of broadcasts waiting for their time.")
+	fmt.Fprintln(w, "# TYPE broadcaster_scheduled_broadcasts gauge")
+	fmt.Fprintf(w, "broadcaster_scheduled_broadcasts %d\n", pending)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+func TestScheduleFileKeepsNoCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scheduled.json")
+	file, clock := *scheduleFile, schedulerClock
+	*scheduleFile, schedulerClock = path, newFakeClock(time.Now())
+	defer func() {
+		*scheduleFile, schedulerClock = file, clock
+	}()
+
+	r := httptest.NewRequest("BAN", "/products", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set("Cookie", "session=secret")
+	r.Header.Set("Proxy-Authorization", "Basic secret")
+	r.Header.Set("X-Keys", "product-42")
+
+	sb, err := scheduleBroadcast("scheduled-test", r, "", schedulerClock.Now().Add(time.Hour), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		schedulesLocker.Lock()
+		delete(schedules, sb.ID)
+		schedulesLocker.Unlock()
+	}()
+
+	if v := sb.Headers.Get("X-Keys"); v != "product-42" {
+		t.Errorf("X-Keys: got %q, want product-42", v)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "secret") {
+		t.Errorf("credentials written to disk:\n%s", content)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("file mode: got %o, want 600", mode)
+	}
+}
+
+func TestScheduledBroadcastAuditsItsClient(t *testing.T) {
+	records := readAudit(t)
+
+	path := filepath.Join(t.TempDir(), "scheduled.json")
+	file, clock := *scheduleFile, schedulerClock
+	*scheduleFile, schedulerClock = path, newFakeClock(time.Now())
+	defer func() {
+		*scheduleFile, schedulerClock = file, clock
+	}()
+
+	cache := testCache(t, func(w http.ResponseWriter, r *http.Request) {})
+	useGroups(t, dao.Group{Name: "prod", Caches: []dao.Cache{cache}})
+
+	r := httptest.NewRequest("PURGE", "/products", nil)
+	r.RemoteAddr = "192.0.2.7:41234"
+	r.SetBasicAuth("alice", "secret")
+	r.Header.Set("X-Group", "prod")
+
+	sb, err := scheduleBroadcast("scheduled-audit", r, "prod", schedulerClock.Now().Add(time.Hour), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runSchedule(sb)
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, ab := pollBroadcast(t, sb.ID); ab.State == asyncDone {
+			break
+		}
+	}
+
+	got := records()
+	if len(got) != 1 {
+		t.Fatalf("got the records %+v", got)
+	}
+	if got[0].ID != sb.ID || got[0].Identity != "alice" || got[0].IP != "192.0.2.7" {
+		t.Errorf("got the record %+v, want it on behalf of alice from 192.0.2.7", got[0])
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	broadcastServer *http.Server
+	apiServer       *http.Server
+
+	// Work carried on once the request which started it
+	// got its response, such as asynchronous broadcasts
+	// and webhook deliveries.
+	background sync.WaitGroup
+	// Jobs which have not been handled yet.
+	pendingJobs sync.WaitGroup
+
+	shutdownDone = make(chan struct{})
+	logFlushed   = make(chan struct{})
+)
+
+// waitUntil waits for the wait group, unless ctx is done
+// beforehand in which case it returns false.
+func waitUntil(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// shutdown stops accepting new requests, then waits for the
+// in-flight broadcasts and queued jobs to be done, for the grace
+// period at most, and finally flushes the log.
+func shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), *gracePeriod)
+	defer cancel()
+
+	fmt.Println("Shutting down, draining in-flight broadcasts.")
+
+	// Pending scheduled broadcasts are left for the next start.
+	stopSchedules()
+	stopCrons()
+
+	var wg sync.WaitGroup
+	for _, srv := range []*http.Server{broadcastServer, apiServer} {
+		if srv == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			srv.Shutdown(ctx)
+		}(srv)
+	}
+	wg.Wait()
+
+	// Once the servers are down, only background work can
+	// queue new jobs.
+	if !waitUntil(ctx, &background) || !waitUntil(ctx, &pendingJobs) {
+		fmt.Println("Grace period is over, in-flight broadcasts are dropped.")
+	}
+
+	closeAuditLog()
+	flushLog()
+}
+
+// flushLog waits for the log entries sent so far to be written.
+func flushLog() {
+	if !*enableLog {
+		return
+	}
+
+	// A nil entry marks the end of the log.
+	logChannel <- nil
+
+	select {
+	case <-logFlushed:
+	case <-time.After(time.Second):
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+// useServer serves handler as the broadcast server, and starts the
+// schedules and crons again once the test shut it down.
+func useServer(t *testing.T, handler http.HandlerFunc) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broadcastServer = &http.Server{Handler: handler}
+	go broadcastServer.Serve(l)
+
+	t.Cleanup(func() {
+		broadcastServer.Close()
+		broadcastServer = nil
+
+		schedulesLocker.Lock()
+		schedulesStopped = false
+		schedulesLocker.Unlock()
+
+		cronsLocker.Lock()
+		cronsStopped = false
+		cronsLocker.Unlock()
+	})
+
+	return "http://" + l.Addr().String()
+}
+
+func TestShutdownDrainsInFlightBroadcasts(t *testing.T) {
+	var (
+		received = make(chan struct{})
+		release  = make(chan struct{})
+	)
+
+	cache := testCache(t, func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-release
+	})
+	useGroups(t, dao.Group{Name: "prod", Caches: []dao.Cache{cache}})
+	addr := useServer(t, reqHandler)
+
+	responses := make(chan int, 1)
+	go func() {
+		r, _ := http.NewRequest("PURGE", addr+"/page", nil)
+		r.Header.Set("X-Group", "prod")
+
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			responses <- 0
+			return
+		}
+		resp.Body.Close()
+		responses <- resp.StatusCode
+	}()
+	<-received
+
+	done := make(chan struct{})
+	go func() {
+		shutdown()
+		close(done)
+	}()
+
+	// New requests are refused while the broadcast is drained.
+	time.Sleep(20 * time.Millisecond)
+	if resp, err := http.Get(addr + "/other"); err == nil {
+		resp.Body.Close()
+		t.Error("a new request was accepted while shutting down")
+	}
+
+	select {
+	case <-done:
+		t.Fatal("shutdown returned before the in-flight broadcast was done")
+	default:
+	}
+
+	close(release)
+
+	if status := <-responses; status != http.StatusOK {
+		t.Errorf("the in-flight broadcast got a %d, want a 200", status)
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdown never returned once the broadcast was drained")
+	}
+}
+
+func TestShutdownGracePeriod(t *testing.T) {
+	var (
+		received = make(chan struct{})
+		release  = make(chan struct{})
+	)
+	defer close(release)
+
+	// A request which is never done.
+	addr := useServer(t, func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-release
+	})
+	go http.Get(addr + "/page")
+	<-received
+
+	saved := *gracePeriod
+	*gracePeriod = 50 * time.Millisecond
+	t.Cleanup(func() { *gracePeriod = saved })
+
+	start := time.Now()
+	shutdown()
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("shutdown took %s, past its grace period", elapsed)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+// stageResult is the outcome of a stage of a broadcast against a
+// group with stages.
+type stageResult struct {
+	Name      string         `json:"name"`
+	Status    int            `json:"status"`
+	PolicyMet bool           `json:"policy_met"`
+	Skipped   bool           `json:"skipped,omitempty"`
+	Caches    map[string]int `json:"caches"`
+}
+
+// stagePolicy is the policy a stage must meet before the next one
+// is broadcasted to, the one of the group if it has one.
+func stagePolicy(group dao.Group) *dao.Policy {
+	if group.Policy != nil {
+		return group.Policy
+	}
+	return dao.DefaultPolicy()
+}
+
+// skippedResult is the outcome reported for a cache of a stage
+// which was not broadcasted to since an earlier one failed.
+func skippedResult(cache dao.Cache, failedStage string) cacheResult {
+	return cacheResult{
+		Name:    cache.Name,
+		Address: cache.Address,
+		Status:  http.StatusFailedDependency,
+		Error:   "skipped, stage " + failedStage + " failed",
+	}
+}
+
+// newStageResult judges the outcome of the caches of a stage
+// against the policy.
+func newStageResult(name string, caches []cacheResult, policy *dao.Policy, skipped bool) stageResult {
+	sr := &broadcastResult{Caches: caches, policy: policy}
+	sr.applyPolicy()
+
+	out := stageResult{Name: name, Status: sr.Status, PolicyMet: *sr.PolicyMet, Caches: sr.codes()}
+	if skipped {
+		out.Status, out.Skipped = http.StatusFailedDependency, true
+	}
+	return out
+}
+
+// stagesHeader sums up the status code of each stage, such as
+// "shield=200, edge=424", for the X-Stages header.
+func stagesHeader(stages []stageResult) string {
+	var parts = make([]string, len(stages))
+	for i, st := range stages {
+		parts[i] = st.Name + "=" + strconv.Itoa(st.Status)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// progressStream writes the outcome of each cache as soon as it is
+// known, followed by a summary once the broadcast is done. Clients
+// ask for it through the Accept header, either as newline delimited
+// JSON or as server-sent events.
+type progressStream struct {
+	w    http.ResponseWriter
+	sse  bool
+	lock sync.Mutex
+	sent int
+}
+
+// broadcastSummary ends the stream of a broadcast.
+type broadcastSummary struct {
+	Status    int           `json:"status"`
+	PolicyMet *bool         `json:"policy_met,omitempty"`
+	Caches    int           `json:"caches"`
+	Failures  []cacheResult `json:"failures"`
+	Stages    []stageResult `json:"stages,omitempty"`
+	Hosts     []hostResult  `json:"hosts,omitempty"`
+}
+
+// newProgressStream starts streaming the response if the client
+// asked for it, and returns nil otherwise. The status code is sent
+// right away, the one the broadcast ends up with is found in the
+// summary.
+func newProgressStream(w http.ResponseWriter, r *http.Request) *progressStream {
+	var (
+		accept = r.Header.Get("Accept")
+		ps     = &progressStream{w: w}
+	)
+
+	switch {
+	case strings.Contains(accept, "text/event-stream"):
+		ps.sse = true
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	case strings.Contains(accept, "application/x-ndjson"):
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	default:
+		return nil
+	}
+
+	w.WriteHeader(http.StatusOK)
+	ps.flush()
+
+	return ps
+}
+
+func (ps *progressStream) flush() {
+	if f, ok := ps.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// write sends v as an event of the given name. Newline delimited
+// JSON has no such thing as event names, the summary is wrapped in
+// an object instead.
+func (ps *progressStream) write(event string, v interface{}) {
+	if !ps.sse && event == "summary" {
+		v = map[string]interface{}{"summary": v}
+	}
+
+	out, _ := json.Marshal(v)
+
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if ps.sse {
+		fmt.Fprintf(ps.w, "event: %s\ndata: %s\n\n", event, out)
+	} else {
+		ps.w.Write(out)
+		ps.w.Write([]byte("\n"))
+	}
+
+	ps.sent++
+	ps.flush()
+}
+
+func (ps *progressStream) result(cr cacheResult) {
+	ps.write("result", cr)
+}
+
+// finish sends the summary of the broadcast. Outcomes are sent
+// beforehand if none went through yet, which happens when the
+// broadcast was coalesced with another one.
+func (ps *progressStream) finish(res *broadcastResult) {
+	if ps.sent == 0 {
+		for _, cr := range res.Caches {
+			ps.result(cr)
+		}
+	}
+
+	ps.write("summary", broadcastSummary{Status: res.Status, PolicyMet: res.PolicyMet, Caches: len(res.Caches), Failures: res.failures(), Stages: res.Stages, Hosts: res.Hosts})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+func TestProgressStreamAccept(t *testing.T) {
+	tests := []struct {
+		accept, contentType string
+	}{
+		{"application/x-ndjson", "application/x-ndjson"},
+		{"text/event-stream", "text/event-stream"},
+		{"application/json", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("PURGE", "/", nil)
+		r.Header.Set("Accept", tt.accept)
+		w := httptest.NewRecorder()
+
+		ps := newProgressStream(w, r)
+		if (ps != nil) != (tt.contentType != "") {
+			t.Errorf("Accept %q: got a stream %v", tt.accept, ps != nil)
+			continue
+		}
+		if ps != nil && w.Header().Get("Content-Type") != tt.contentType {
+			t.Errorf("Accept %q: got the content type %q", tt.accept, w.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestProgressStreamFraming(t *testing.T) {
+	res := &broadcastResult{Status: http.StatusOK, Caches: []cacheResult{{Name: "Cache1", Status: 200}}}
+
+	r := httptest.NewRequest("PURGE", "/", nil)
+	r.Header.Set("Accept", "application/x-ndjson")
+	w := httptest.NewRecorder()
+	ps := newProgressStream(w, r)
+	ps.result(res.Caches[0])
+	ps.finish(res)
+
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("ndjson: got %q", w.Body.String())
+	}
+	var cr cacheResult
+	if err := json.Unmarshal([]byte(lines[0]), &cr); err != nil || cr.Name != "Cache1" {
+		t.Errorf("ndjson result: got %q", lines[0])
+	}
+	var summary map[string]broadcastSummary
+	if err := json.Unmarshal([]byte(lines[1]), &summary); err != nil || summary["summary"].Caches != 1 {
+		t.Errorf("ndjson summary: got %q", lines[1])
+	}
+
+	r.Header.Set("Accept", "text/event-stream")
+	w = httptest.NewRecorder()
+	ps = newProgressStream(w, r)
+	ps.finish(res)
+
+	events := strings.Split(w.Body.String(), "\n\n")
+	if len(events) != 3 || events[2] != "" {
+		t.Fatalf("sse: got %q", w.Body.String())
+	}
+	if !strings.HasPrefix(events[0], "event: result\ndata: {") {
+		t.Errorf("sse result: got %q", events[0])
+	}
+	if !strings.HasPrefix(events[1], "event: summary\ndata: {\"status\":200") {
+		t.Errorf("sse summary: got %q", events[1])
+	}
+}
+
+func TestStreamedBroadcastProgress(t *testing.T) {
+	release := make(chan struct{})
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	fast := testCache(t, func(w http.ResponseWriter, r *http.Request) {})
+	slow := testCache(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	useGroups(t, dao.Group{Name: "prod", Caches: []dao.Cache{slow, fast}})
+
+	srv := httptest.NewServer(http.HandlerFunc(reqHandler))
+	defer srv.Close()
+
+	r, _ := http.NewRequest("PURGE", srv.URL+"/stream", nil)
+	r.Header.Set("X-Group", "prod")
+	r.Header.Set("Accept", "application/x-ndjson")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	lines := bufio.NewScanner(resp.Body)
+
+	// The fast cache is reported while the slow one still holds
+	// the broadcast back.
+	var cr cacheResult
+	if !lines.Scan() || json.Unmarshal(lines.Bytes(), &cr) != nil || cr.Name != fast.Name {
+		t.Fatalf("first line: got %q, want the outcome of %s", lines.Text(), fast.Name)
+	}
+
+	close(release)
+
+	if !lines.Scan() || json.Unmarshal(lines.Bytes(), &cr) != nil || cr.Name != slow.Name || cr.Status != http.StatusServiceUnavailable {
+		t.Fatalf("second line: got %q, want the outcome of %s", lines.Text(), slow.Name)
+	}
+
+	var summary map[string]broadcastSummary
+	if !lines.Scan() || json.Unmarshal(lines.Bytes(), &summary) != nil {
+		t.Fatalf("summary: got %q", lines.Text())
+	}
+	if s := summary["summary"]; s.Caches != 2 || len(s.Failures) != 1 {
+		t.Errorf("summary: got %+v", s)
+	}
+}
+
+func TestStreamedBulkRequest(t *testing.T) {
+	cache := testCache(t, func(w http.ResponseWriter, r *http.Request) {})
+	useGroups(t, dao.Group{Name: "prod", Caches: []dao.Cache{cache}})
+
+	r := httptest.NewRequest(http.MethodPost, "/bulk", strings.NewReader("/a\n/b\n"))
+	r.Header.Set("X-Group", "prod")
+	r.Header.Set("Accept", "application/x-ndjson")
+	w := httptest.NewRecorder()
+	bulkHandler(w, r)
+
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %q", w.Body.String())
+	}
+
+	var seen = make(map[int]string)
+	for _, line := range lines[:2] {
+		var p bulkProgress
+		if err := json.Unmarshal([]byte(line), &p); err != nil {
+			t.Fatal(err)
+		}
+		seen[p.Item] = p.Path
+	}
+	if seen[0] != "/a" || seen[1] != "/b" {
+		t.Errorf("got the items %v", seen)
+	}
+
+	var summary map[string]bulkSummary
+	if err := json.Unmarshal([]byte(lines[2]), &summary); err != nil || summary["summary"].Items != 2 {
+		t.Errorf("summary: got %q", lines[2])
+	}
+}
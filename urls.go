@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+// urlsResult holds the outcome of a bulk request for each of the
+// groups the urls were routed to.
+type urlsResult struct {
+	Status int                    `json:"status"`
+	Groups map[string]*bulkResult `json:"groups"`
+}
+
+// routeURL turns an item holding an absolute url into one holding
+// its path and host, and returns the groups serving that host.
+func routeURL(item bulkItem) (bulkItem, []string, error) {
+	u, err := url.Parse(item.Path)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return item, nil, fmt.Errorf("Invalid url %q, absolute urls are expected.", item.Path)
+	}
+
+	item.Path, item.Host = u.RequestURI(), u.Host
+
+	groupNames := hostGroups(u.Host)
+	if len(groupNames) == 0 {
+		return item, nil, fmt.Errorf("No group serves %s.", u.Hostname())
+	}
+	return item, groupNames, nil
+}
+
+// urlsHandler serves POST /urls, which broadcasts absolute urls to
+// the groups serving their host, according to the [group.hosts]
+// sections of the configuration. The body is the same as the one
+// of a bulk request, urls taking the place of paths, and the answer
+// holds the outcome of the bulk request sent to each group.
+func urlsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	timeout, err := broadcastTimeout(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	items, err := parseBulkItems(r)
+	if err != nil {
+		http.Error(w, "Invalid urls request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(items) == 0 {
+		http.Error(w, "No urls to broadcast.", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		rs      bulkRoutes
+		targets = make(map[string]dao.Group)
+	)
+
+	for _, item := range items {
+		item, groupNames, err := routeURL(item)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		for _, name := range groupNames {
+			group, found := targets[name]
+			if !found {
+				if group, err = targetGroup(name); err != nil {
+					http.Error(w, err.Error(), http.StatusNotFound)
+					return
+				}
+				targets[name] = group
+			}
+
+			br, err := bulkRequest(item, r, group)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			rs.add(name, group, br)
+		}
+	}
+
+	if isDryRun(r) {
+		writeBulkDryRun(w, r, &rs)
+		return
+	}
+
+	hooks, err := webhookUrls(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := guardBulk(r, &rs); err != nil {
+		sendToLogChannel("Rejected: ", err.Error(), "\n")
+		http.Error(w, err.Error(), http.StatusPreconditionRequired)
+		return
+	}
+
+	sendToLogChannel("Broadcast of ", fmt.Sprint(len(items)), " urls to ", fmt.Sprint(len(rs.routes)), " groups.\n")
+
+	var (
+		id      = newBroadcastId()
+		started = time.Now()
+	)
+
+	w.Header().Set("X-Broadcast-Id", id)
+
+	ctx, cancel := withTimeout(r.Context(), timeout)
+	defer cancel()
+
+	all, parts := broadcastRoutedBulk(ctx, &rs, nil)
+	auditRoutedBulk(id, r, &rs, started, parts)
+
+	var res = &urlsResult{Status: http.StatusOK, Groups: make(map[string]*bulkResult)}
+	for i, route := range rs.routes {
+		res.Groups[route.name] = parts[i]
+	}
+
+	// The status is the first failure, in the order of the groups.
+	var names []string
+	for name := range res.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if status := res.Groups[name].Status; status >= http.StatusMultipleChoices {
+			res.Status = status
+			break
+		}
+	}
+
+	if len(hooks) > 0 {
+		payload := newBulkWebhookPayload(id, r, &rs, started, time.Now(), all, parts)
+		payload.Status = res.Status
+		deliverWebhooks(hooks, payload)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.Status)
+
+	out, _ := json.MarshalIndent(res, "", "  ")
+	w.Write(out)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+func TestRouteURL(t *testing.T) {
+	useGroups(t,
+		dao.Group{Name: "prod", Hosts: []string{"www.example.com", "*.example.com"}},
+		dao.Group{Name: "eu", Hosts: []string{"www.example.eu"}},
+	)
+
+	tests := []struct {
+		url              string
+		path, host, want string
+	}{
+		{"https://www.example.com/page?id=1", "/page?id=1", "www.example.com", "prod"},
+		{"http://m.example.com", "/", "m.example.com", "prod"},
+		{"http://WWW.example.eu:8080/a%20b", "/a%20b", "WWW.example.eu:8080", "eu"},
+	}
+
+	for _, tt := range tests {
+		item, groupNames, err := routeURL(bulkItem{Path: tt.url})
+		if err != nil {
+			t.Errorf("%s: %v", tt.url, err)
+			continue
+		}
+		if item.Path != tt.path || item.Host != tt.host || strings.Join(groupNames, ",") != tt.want {
+			t.Errorf("%s: got %s on %s for %v", tt.url, item.Path, item.Host, groupNames)
+		}
+	}
+
+	for _, invalid := range []string{"/page", "www.example.com/page", "mailto:someone@example.com", "http://www.example.org/page", "http://%zz/"} {
+		if _, _, err := routeURL(bulkItem{Path: invalid}); err == nil {
+			t.Errorf("%s: accepted", invalid)
+		}
+	}
+}
+
+func TestUrlsHandler(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		received = make(map[string][]string)
+	)
+	recorder := func(name string) dao.Cache {
+		return testCache(t, func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			received[name] = append(received[name], r.Host+r.URL.RequestURI())
+			lock.Unlock()
+		})
+	}
+
+	useGroups(t,
+		dao.Group{Name: "prod", Hosts: []string{"www.example.com"}, Caches: []dao.Cache{recorder("prod")}},
+		dao.Group{Name: "eu", Hosts: []string{"www.example.eu"}, Caches: []dao.Cache{recorder("eu")}},
+	)
+
+	body := "https://www.example.com/a\n\n" +
+		`{"path": "https://www.example.eu/b?page=2", "method": "BAN"}` + "\n" +
+		"https://www.example.com/c\n"
+	r := httptest.NewRequest(http.MethodPost, "/urls", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	urlsHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got a %d: %s", w.Code, w.Body.String())
+	}
+
+	var res urlsResult
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Groups) != 2 || len(res.Groups["prod"].Items) != 2 || len(res.Groups["eu"].Items) != 1 {
+		t.Errorf("got the result %s", w.Body.String())
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if got := strings.Join(received["prod"], ","); got != "www.example.com/a,www.example.com/c" && got != "www.example.com/c,www.example.com/a" {
+		t.Errorf("prod received %s", got)
+	}
+	if got := strings.Join(received["eu"], ","); got != "www.example.eu/b?page=2" {
+		t.Errorf("eu received %s", got)
+	}
+}
+
+func TestUrlsHandlerRejects(t *testing.T) {
+	useGroups(t, dao.Group{Name: "prod", Hosts: []string{"www.example.com"}})
+
+	tests := []struct {
+		method, body, timeout string
+		want                  int
+	}{
+		{http.MethodGet, "", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "", "", http.StatusBadRequest},
+		{http.MethodPost, "\n  \n", "", http.StatusBadRequest},
+		{http.MethodPost, "{not json\n", "", http.StatusBadRequest},
+		{http.MethodPost, "https://www.example.com/a\n/relative\n", "", http.StatusBadRequest},
+		{http.MethodPost, "https://www.example.org/a\n", "", http.StatusBadRequest},
+		{http.MethodPost, "https://www.example.com/a\n", "soon", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/urls", strings.NewReader(tt.body))
+		if tt.timeout != "" {
+			r.Header.Set("X-Timeout", tt.timeout)
+		}
+		w := httptest.NewRecorder()
+		urlsHandler(w, r)
+
+		if w.Code != tt.want {
+			t.Errorf("%s %q: got a %d, want a %d", tt.method, tt.body, w.Code, tt.want)
+		}
+	}
+}
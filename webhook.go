@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+const maxWebhookBackoff = time.Minute
+
+var webhookClient = &http.Client{Timeout: time.Duration(requestTimeout) * time.Second}
+
+// webhookPayload is the summary of a finished broadcast
+// posted to the webhooks.
+type webhookPayload struct {
+	ID        string        `json:"id"`
+	Method    string        `json:"method"`
+	Path      string        `json:"path"`
+	Group     string        `json:"group,omitempty"`
+	Started   time.Time     `json:"started"`
+	Finished  time.Time     `json:"finished"`
+	Status    int           `json:"status"`
+	PolicyMet *bool         `json:"policy_met,omitempty"`
+	Caches    []cacheResult `json:"caches"`
+	Failures  []cacheResult `json:"failures"`
+	Stages    []stageResult `json:"stages,omitempty"`
+	Hosts     []hostResult  `json:"hosts,omitempty"`
+	// Outcome of each item of a bulk or url request.
+	Items []bulkItemResult `json:"items,omitempty"`
+}
+
+func newWebhookPayload(id, method, path, groupName string, started, finished time.Time, res *broadcastResult) *webhookPayload {
+	return &webhookPayload{
+		ID:        id,
+		Method:    method,
+		Path:      path,
+		Group:     groupName,
+		Started:   started,
+		Finished:  finished,
+		Status:    res.Status,
+		PolicyMet: res.PolicyMet,
+		Caches:    res.Caches,
+		Failures:  res.failures(),
+		Stages:    res.Stages,
+		Hosts:     res.Hosts,
+	}
+}
+
+// newBulkWebhookPayload sums up a bulk or url request, the caches
+// of every item being listed along with the outcome of each item.
+func newBulkWebhookPayload(id string, r *http.Request, rs *bulkRoutes, started, finished time.Time, res *bulkResult, parts []*bulkResult) *webhookPayload {
+	payload := &webhookPayload{
+		ID:        id,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Group:     rs.names(),
+		Started:   started,
+		Finished:  finished,
+		Status:    res.Status,
+		PolicyMet: res.PolicyMet,
+		Caches:    []cacheResult{},
+		Failures:  []cacheResult{},
+		Items:     res.Items,
+	}
+
+	for _, part := range parts {
+		for _, ir := range part.outcomes {
+			payload.Caches = append(payload.Caches, ir.Caches...)
+			payload.Failures = append(payload.Failures, ir.failures()...)
+		}
+	}
+
+	return payload
+}
+
+// webhookUrls returns the globally configured webhooks along with
+// the ones requested through the X-Callback-Url header. Requested
+// urls must point to one of the -callback-hosts, so that clients
+// can't have the broadcaster post anywhere else.
+func webhookUrls(r *http.Request) ([]string, error) {
+	var urls = splitUrls(*webhooks)
+
+	for _, u := range splitUrls(r.Header.Get("X-Callback-Url")) {
+		if !callbackAllowed(u) {
+			return nil, fmt.Errorf("Callback url %q is not allowed.", u)
+		}
+		urls = append(urls, u)
+	}
+
+	return urls, nil
+}
+
+func splitUrls(list string) []string {
+	var urls []string
+	for _, u := range strings.Split(list, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// callbackAllowed reports whether a callback url is an http one
+// pointing to one of the -callback-hosts.
+func callbackAllowed(callback string) bool {
+	u, err := url.Parse(callback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+
+	for _, host := range strings.Split(*callbackHosts, ",") {
+		if host = dao.NormalizeHost(strings.TrimSpace(host)); host != "" && host == dao.NormalizeHost(u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// signWebhook computes the signature sent along with a payload,
+// an hex encoded HMAC-SHA256 of the timestamp and the body.
+func signWebhook(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(*webhookSecret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhooks posts the payload to each of the urls,
+// every delivery being retried on its own.
+func deliverWebhooks(urls []string, payload *webhookPayload) {
+	body, _ := json.Marshal(payload)
+
+	for _, u := range urls {
+		background.Add(1)
+		go func(u string) {
+			defer background.Done()
+			deliverWebhook(u, body)
+		}(u)
+	}
+}
+
+// deliverWebhook posts the body to the url, retrying with an
+// exponential backoff until a 2xx is received or the retries
+// are exhausted.
+func deliverWebhook(url string, body []byte) {
+	var (
+		err     error
+		backoff = *webhookBackoff
+	)
+
+	for i := 0; i <= *webhookRetries; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxWebhookBackoff {
+				backoff = maxWebhookBackoff
+			}
+		}
+
+		if err = postWebhook(url, body); err == nil {
+			return
+		}
+	}
+
+	sendToLogChannel("Webhook ", url, " failed: ", err.Error(), "\n")
+}
+
+func postWebhook(url string, body []byte) error {
+	r, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	r.Header.Set("Content-Type", "application/json")
+
+	if *webhookSecret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		r.Header.Set("X-Broadcaster-Timestamp", timestamp)
+		r.Header.Set("X-Broadcaster-Signature", signWebhook(timestamp, body))
+	}
+
+	resp, err := webhookClient.Do(r)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	dao "github.com/wearephenix/varnish-broadcaster/dao"
+)
+
+func TestCallbackAllowed(t *testing.T) {
+	defer func(hosts string) { *callbackHosts = hosts }(*callbackHosts)
+	*callbackHosts = "hooks.example.com, CI.example.com:8080"
+
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://hooks.example.com/done", true},
+		{"http://hooks.example.com:9000/done", true},
+		{"https://ci.example.com/done", true},
+		{"https://HOOKS.example.com./done", true},
+		{"https://other.example.com/done", false},
+		{"https://hooks.example.com.evil.com/done", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"ftp://hooks.example.com/done", false},
+		{"hooks.example.com/done", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := callbackAllowed(tt.url); got != tt.want {
+			t.Errorf("callbackAllowed(%q) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookUrls(t *testing.T) {
+	defer func(hosts, hooks string) { *callbackHosts, *webhooks = hosts, hooks }(*callbackHosts, *webhooks)
+	*webhooks = "http://internal/hook"
+	*callbackHosts = ""
+
+	r, _ := http.NewRequest("PURGE", "http://localhost/", nil)
+
+	urls, err := webhookUrls(r)
+	if err != nil || len(urls) != 1 {
+		t.Fatalf("without callback: %v, %v", urls, err)
+	}
+
+	r.Header.Set("X-Callback-Url", "http://hooks.example.com/a")
+	if _, err = webhookUrls(r); err == nil {
+		t.Error("callback accepted without -callback-hosts")
+	}
+
+	*callbackHosts = "hooks.example.com"
+	urls, err = webhookUrls(r)
+	if err != nil || len(urls) != 2 {
+		t.Errorf("allowed callback: %v, %v", urls, err)
+	}
+}
+
+// receiveWebhooks sets up a webhook for the test and returns the
+// payloads posted to it.
+func receiveWebhooks(t *testing.T) <-chan webhookPayload {
+	payloads := make(chan webhookPayload, 4)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload webhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		payloads <- payload
+	}))
+	t.Cleanup(srv.Close)
+
+	saved := *webhooks
+	*webhooks = srv.URL
+	t.Cleanup(func() { *webhooks = saved })
+
+	return payloads
+}
+
+func nextPayload(t *testing.T, payloads <-chan webhookPayload) webhookPayload {
+	t.Helper()
+
+	select {
+	case payload := <-payloads:
+		return payload
+	case <-time.After(2 * time.Second):
+		t.Fatal("no webhook delivered")
+	}
+	return webhookPayload{}
+}
+
+func TestWebhooksOfBulkRequests(t *testing.T) {
+	payloads := receiveWebhooks(t)
+
+	cache := testCache(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	useGroups(t, dao.Group{Name: "prod", Hosts: []string{"www.example.com"}, Caches: []dao.Cache{cache}})
+
+	tests := []struct {
+		handler http.HandlerFunc
+		path    string
+		body    string
+	}{
+		{bulkHandler, "/bulk", "/fine\n/broken\n"},
+		{urlsHandler, "/urls", "https://www.example.com/fine\nhttps://www.example.com/broken\n"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+		r.Header.Set("X-Group", "prod")
+		w := httptest.NewRecorder()
+		tt.handler(w, r)
+
+		payload := nextPayload(t, payloads)
+		if payload.ID != w.Header().Get("X-Broadcast-Id") || payload.Path != tt.path || payload.Group != "prod" {
+			t.Errorf("%s: got %+v", tt.path, payload)
+		}
+		if len(payload.Items) != 2 || len(payload.Caches) != 2 || len(payload.Failures) != 1 {
+			t.Errorf("%s: got %d items, %d caches and %d failures, want 2, 2 and 1", tt.path, len(payload.Items), len(payload.Caches), len(payload.Failures))
+		}
+	}
+}
+
+func TestWebhooksOfRecurringBroadcasts(t *testing.T) {
+	payloads := receiveWebhooks(t)
+
+	cache := testCache(t, func(w http.ResponseWriter, r *http.Request) {})
+	useGroups(t, dao.Group{Name: "prod", Caches: []dao.Cache{cache}})
+
+	settings := &dao.CronSettings{Name: "feed", Method: "PURGE", Path: "/feed"}
+	cj := &cronJob{group: "prod", settings: settings, outcomes: make(map[string]int64), running: 1}
+	runCron(context.Background(), cj, cronKey("prod", "feed"), settings)
+
+	payload := nextPayload(t, payloads)
+	if payload.ID == "" || payload.Path != "/feed" || payload.Group != "prod" || len(payload.Caches) != 1 {
+		t.Errorf("got %+v", payload)
+	}
+}